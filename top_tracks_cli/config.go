@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// playlistSpec configures one automated playlist.
+type playlistSpec struct {
+	Name          string `json:"name"`
+	Description   string `json:"description"`
+	Public        bool   `json:"public"`
+	Collaborative bool   `json:"collaborative"`
+}
+
+// fileConfig is the file read by --config.
+type fileConfig struct {
+	// Playlists are the short, medium, and long term track playlists, in that order.
+	Playlists []playlistSpec `json:"playlists"`
+}
+
+// loadConfig reads a JSON config file, e.g.
+//
+//	{"playlists": [
+//		{"name": "Right Now", "description": "last 4 weeks", "public": true},
+//		{"name": "This Year"},
+//		{"name": "All Time", "collaborative": true}
+//	]}
+func loadConfig(path string) (*fileConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg fileConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(%v): %v", path, err)
+	}
+	if len(cfg.Playlists) != len(terms) {
+		return nil, fmt.Errorf("%v has %d playlists, want %d: short, medium, and long term", path, len(cfg.Playlists), len(terms))
+	}
+	seen := make(map[string]bool)
+	for i, v := range cfg.Playlists {
+		key := strings.ToLower(strings.TrimSpace(v.Name))
+		if key == "" {
+			return nil, fmt.Errorf("%v: playlist %d has no name", path, i+1)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("%v: playlist name %q is used twice", path, v.Name)
+		}
+		seen[key] = true
+		if v.Public && v.Collaborative {
+			return nil, fmt.Errorf("%v: playlist %q can't be both public and collaborative", path, v.Name)
+		}
+	}
+	return &cfg, nil
+}
+
+// trackSet returns the automated track playlists described by cfg, with matchers built
+// the same way as the default ones: ignoring case and surrounding whitespace, and
+// allowing the month suffix added by --dated.
+func (cfg *fileConfig) trackSet() automatedSet {
+	set := automatedSet{source: sourceTracks, specs: cfg.Playlists, ranges: allRanges}
+	var quoted []string
+	for _, v := range cfg.Playlists {
+		q := regexp.QuoteMeta(strings.TrimSpace(v.Name))
+		set.names = append(set.names, strings.TrimSpace(v.Name))
+		set.termRes = append(set.termRes, regexp.MustCompile("(?i)^\\s*"+q+"( \\d{4}-\\d{2})?\\s*$"))
+		quoted = append(quoted, q)
+	}
+	set.match = regexp.MustCompile("(?i)^\\s*(" + strings.Join(quoted, "|") + ")\\s*$")
+	set.dated = regexp.MustCompile("(?i)^\\s*(" + strings.Join(quoted, "|") + ")( \\d{4}-\\d{2})?\\s*$")
+	return set
+}
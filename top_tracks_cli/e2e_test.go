@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The end-to-end tests run the test binary itself as the CLI, pointed with --api_base
+// at a fakeServer, so everything from flag parsing to the API calls is exercised.
+// runMainEnv tells the child process to run main instead of the tests.
+const runMainEnv = "TOP_TRACKS_CLI_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeServer is an in-process Spotify Web API serving the endpoints that fill and
+// purge use, from canned playlists and top tracks. It records every request it gets.
+type fakeServer struct {
+	t *testing.T
+
+	mu sync.Mutex
+	// playlists are the user's playlists, in library order.
+	playlists []*fakePlaylist
+	// top are the user's top track IDs, by time_range.
+	top map[string][]string
+	// requests are "METHOD /path" for every request received, in order.
+	requests []string
+	// added are the URIs POSTed to each playlist, by playlist ID, in order.
+	added map[string][]string
+	// removed are the URIs DELETEd from each playlist, by playlist ID.
+	removed map[string][]string
+}
+
+type fakePlaylist struct {
+	id, name, owner string
+	// uris are the playlist's items.
+	uris []string
+}
+
+func newFakeServer(t *testing.T, playlists ...*fakePlaylist) *fakeServer {
+	return &fakeServer{
+		t:         t,
+		playlists: playlists,
+		top:       make(map[string][]string),
+		added:     make(map[string][]string),
+		removed:   make(map[string][]string),
+	}
+}
+
+// start serves f. Its playlists and top tracks must be set up before.
+func (f *fakeServer) start() *httptest.Server {
+	srv := httptest.NewServer(f)
+	f.t.Cleanup(srv.Close)
+	return srv
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/me":
+		f.reply(w, http.StatusOK, map[string]any{"id": "me", "display_name": "Me"})
+	case r.Method == http.MethodGet && r.URL.Path == "/me/playlists":
+		var items []any
+		for _, p := range f.playlists {
+			items = append(items, p.simple())
+		}
+		f.reply(w, http.StatusOK, page(r, items))
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[0] == "users" && parts[2] == "playlists":
+		var body struct {
+			Name string `json:"name"`
+		}
+		f.decode(r, &body)
+		p := &fakePlaylist{id: fmt.Sprintf("pl%d", len(f.playlists)+1), name: body.Name, owner: parts[1]}
+		f.playlists = append(f.playlists, p)
+		f.reply(w, http.StatusCreated, p.simple())
+	case r.Method == http.MethodGet && r.URL.Path == "/me/top/tracks":
+		// Spotify rejects offsets past 49 and pages over 50 here.
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if offset > 49 || limit > 50 {
+			f.reply(w, http.StatusBadRequest, map[string]any{"error": map[string]any{"status": 400, "message": "Invalid limit or offset"}})
+			return
+		}
+		var items []any
+		for _, id := range f.top[r.URL.Query().Get("time_range")] {
+			items = append(items, fakeTrack(id))
+		}
+		f.reply(w, http.StatusOK, page(r, items))
+	case len(parts) == 3 && parts[0] == "playlists" && parts[2] == "tracks":
+		p := f.playlist(parts[1])
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		f.serveItems(w, r, p)
+	default:
+		f.t.Errorf("unexpected request %v %v", r.Method, r.URL)
+		http.NotFound(w, r)
+	}
+}
+
+// serveItems serves /playlists/{id}/tracks.
+func (f *fakeServer) serveItems(w http.ResponseWriter, r *http.Request, p *fakePlaylist) {
+	switch r.Method {
+	case http.MethodGet:
+		var items []any
+		for _, uri := range p.uris {
+			items = append(items, fakeItem(uri))
+		}
+		f.reply(w, http.StatusOK, page(r, items))
+	case http.MethodPost:
+		var body struct {
+			URIs []string `json:"uris"`
+		}
+		f.decode(r, &body)
+		p.uris = append(p.uris, body.URIs...)
+		f.added[p.id] = append(f.added[p.id], body.URIs...)
+		f.reply(w, http.StatusCreated, map[string]any{"snapshot_id": "snapshot"})
+	case http.MethodPut:
+		// ReplacePlaylistTracks sends the new items in the query, ReorderPlaylistTracks
+		// a range to move in the body.
+		if r.URL.Query().Has("uris") {
+			p.uris = nil
+			if uris := r.URL.Query().Get("uris"); uris != "" {
+				p.uris = strings.Split(uris, ",")
+			}
+			f.reply(w, http.StatusCreated, map[string]any{"snapshot_id": "snapshot"})
+			return
+		}
+		var body struct {
+			RangeStart   int `json:"range_start"`
+			RangeLength  int `json:"range_length"`
+			InsertBefore int `json:"insert_before"`
+		}
+		f.decode(r, &body)
+		if body.RangeLength == 0 {
+			body.RangeLength = 1
+		}
+		end := body.RangeStart + body.RangeLength
+		if body.RangeStart < 0 || end > len(p.uris) || body.InsertBefore < 0 || body.InsertBefore > len(p.uris) {
+			f.reply(w, http.StatusBadRequest, map[string]any{"error": map[string]any{"status": 400, "message": "Index out of bounds"}})
+			return
+		}
+		moved := append([]string(nil), p.uris[body.RangeStart:end]...)
+		rest := append(append([]string(nil), p.uris[:body.RangeStart]...), p.uris[end:]...)
+		at := body.InsertBefore
+		if at > body.RangeStart {
+			at -= body.RangeLength
+		}
+		p.uris = append(rest[:at], append(moved, rest[at:]...)...)
+		f.reply(w, http.StatusOK, map[string]any{"snapshot_id": "snapshot"})
+	case http.MethodDelete:
+		var body struct {
+			Tracks []struct {
+				URI       string `json:"uri"`
+				Positions []int  `json:"positions"`
+			} `json:"tracks"`
+		}
+		f.decode(r, &body)
+		remove := make(map[int]bool)
+		for _, t := range body.Tracks {
+			f.removed[p.id] = append(f.removed[p.id], t.URI)
+			for i, uri := range p.uris {
+				if uri == t.URI && (t.Positions == nil || containsInt(t.Positions, i)) {
+					remove[i] = true
+				}
+			}
+		}
+		var kept []string
+		for i, uri := range p.uris {
+			if !remove[i] {
+				kept = append(kept, uri)
+			}
+		}
+		p.uris = kept
+		f.reply(w, http.StatusOK, map[string]any{"snapshot_id": "snapshot"})
+	default:
+		f.t.Errorf("unexpected request %v %v", r.Method, r.URL)
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeServer) playlist(id string) *fakePlaylist {
+	for _, p := range f.playlists {
+		if p.id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (f *fakeServer) decode(r *http.Request, v any) {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		f.t.Errorf("%v %v: couldn't decode the body: %v", r.Method, r.URL, err)
+	}
+}
+
+func (f *fakeServer) reply(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		f.t.Errorf("couldn't encode the response: %v", err)
+	}
+}
+
+// writes returns the requests that weren't GETs.
+func (f *fakeServer) writes() []string {
+	var writes []string
+	for _, r := range f.requests {
+		if !strings.HasPrefix(r, http.MethodGet+" ") {
+			writes = append(writes, r)
+		}
+	}
+	sort.Strings(writes)
+	return writes
+}
+
+// page returns the window of items selected by the request's offset and limit as a
+// Spotify paging object.
+func page(r *http.Request, items []any) map[string]any {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil {
+		limit = 20
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	if offset > end {
+		offset = end
+	}
+	p := map[string]any{"items": items[offset:end], "total": len(items), "offset": offset, "limit": limit, "next": nil}
+	if end < len(items) {
+		p["next"] = fmt.Sprintf("http://%v%v?offset=%d&limit=%d", r.Host, r.URL.Path, end, limit)
+	}
+	return p
+}
+
+func (p *fakePlaylist) simple() map[string]any {
+	return map[string]any{
+		"id":     p.id,
+		"name":   p.name,
+		"owner":  map[string]any{"id": p.owner},
+		"tracks": map[string]any{"total": len(p.uris)},
+	}
+}
+
+// fakeTrack returns a track whose duration, one second per character of its ID, gives
+// the sort tests something to order by.
+func fakeTrack(id string) map[string]any {
+	return map[string]any{
+		"id":          id,
+		"uri":         "spotify:track:" + id,
+		"name":        "Song " + id,
+		"type":        "track",
+		"duration_ms": 1000 * len(id),
+		"artists":     []any{map[string]any{"name": "Artist"}},
+	}
+}
+
+// fakeItem returns the playlist item for uri, which is a track, a local file or an
+// episode.
+func fakeItem(uri string) map[string]any {
+	track := fakeTrack(strings.TrimPrefix(uri, "spotify:track:"))
+	local := strings.HasPrefix(uri, "spotify:local:")
+	switch {
+	case local:
+		track["id"] = nil
+		track["uri"] = uri
+	case strings.HasPrefix(uri, "spotify:episode:"):
+		track = map[string]any{"id": strings.TrimPrefix(uri, "spotify:episode:"), "uri": uri, "name": "Episode", "type": "episode"}
+	}
+	return map[string]any{"added_at": "2024-01-01T00:00:00Z", "is_local": local, "track": track}
+}
+
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// runCLI runs the CLI with args against srv, with its config and state in a temporary
+// directory, and returns its stdout. It fails the test if the CLI exits non-zero. srv
+// is closed once the CLI exits, which waits for its handlers, so the fakeServer can be
+// inspected afterwards without locking.
+func runCLI(t *testing.T, srv *httptest.Server, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"--api_base", srv.URL}, args...)...)
+	dir := t.TempDir()
+	cmd.Env = append(os.Environ(), runMainEnv+"=1", "spotify_clientID=test", "HOME="+dir, "XDG_CONFIG_HOME="+dir)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	srv.Close()
+	if err != nil {
+		t.Fatalf("%v: %v\nstdout:\n%s\nstderr:\n%v", args, err, out, stderr.String())
+	}
+	return string(out)
+}
+
+func trackURIs(ids ...string) []string {
+	var uris []string
+	for _, id := range ids {
+		uris = append(uris, "spotify:track:"+id)
+	}
+	return uris
+}
+
+func TestFillEndToEnd(t *testing.T) {
+	f := newFakeServer(t,
+		&fakePlaylist{id: "mix", name: "Road Trip", owner: "me", uris: trackURIs("x")},
+	)
+	f.top["short_term"] = []string{"a", "b", "c"}
+	f.top["medium_term"] = []string{"b", "d"}
+	f.top["long_term"] = []string{"e"}
+
+	out := runCLI(t, f.start(), "playlist", "--fill")
+
+	// The summary table is the only summary in text mode.
+	if !strings.Contains(out, "playlist  added") || strings.Contains(out, ": ok,") || strings.Contains(out, "tracks across") {
+		t.Errorf("output isn't just the summary table:\n%v", out)
+	}
+	wantWrites := []string{
+		"POST /playlists/pl2/tracks",
+		"POST /playlists/pl3/tracks",
+		"POST /playlists/pl4/tracks",
+		"POST /users/me/playlists",
+		"POST /users/me/playlists",
+		"POST /users/me/playlists",
+	}
+	if got := f.writes(); !reflect.DeepEqual(got, wantWrites) {
+		t.Errorf("writes = %q, want %q", got, wantWrites)
+	}
+	wantAdded := map[string][]string{
+		"pl2": trackURIs("a", "b", "c"),
+		"pl3": trackURIs("b", "d"),
+		"pl4": trackURIs("e"),
+	}
+	if !reflect.DeepEqual(f.added, wantAdded) {
+		t.Errorf("added = %q, want %q", f.added, wantAdded)
+	}
+	for id, want := range map[string]string{"pl2": "Favorite Short Term Tracks", "pl3": "Favorite Medium Term Tracks", "pl4": "Favorite Long Term Tracks"} {
+		if p := f.playlist(id); p == nil || p.name != want {
+			t.Errorf("playlist %v = %+v, want one named %q", id, p, want)
+		}
+	}
+	if got := f.playlist("mix").uris; !reflect.DeepEqual(got, trackURIs("x")) {
+		t.Errorf("Road Trip was changed to %q", got)
+	}
+}
+
+func TestFillPastFiftyTopTracksEndToEnd(t *testing.T) {
+	// --count is capped at the 99 tracks Spotify returns instead of failing.
+	for _, limit := range [][]string{{"--limit", "99"}, {"--count", "120"}} {
+		t.Run(limit[0], func(t *testing.T) {
+			f := newFakeServer(t,
+				&fakePlaylist{id: "short", name: "Favorite Short Term Tracks", owner: "me"},
+			)
+			for i := 0; i < 120; i++ {
+				f.top["short_term"] = append(f.top["short_term"], fmt.Sprintf("t%03d", i))
+			}
+
+			runCLI(t, f.start(), append([]string{"playlist", "--fill", "--term", "short", "--retries", "0"}, limit...)...)
+
+			if got, want := f.playlist("short").uris, trackURIs(f.top["short_term"][:99]...); !reflect.DeepEqual(got, want) {
+				t.Errorf("short term playlist = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestFillReorderKeepsEpisodesAndLocalFilesEndToEnd(t *testing.T) {
+	const episode, local = "spotify:episode:ep", "spotify:local:::song:180"
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "maintain rank",
+			args: []string{"--maintain_rank"},
+			// The rest of the playlist keeps its order after the ranked tracks.
+			want: []string{"spotify:track:a", "spotify:track:bbb", episode, "spotify:track:cc", local},
+		},
+		{
+			name: "sort by duration",
+			args: []string{"--sort_final", "duration"},
+			want: append(trackURIs("a", "cc", "bbb"), episode, local),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeServer(t,
+				&fakePlaylist{id: "short", name: "Favorite Short Term Tracks", owner: "me", uris: []string{episode, "spotify:track:cc", local, "spotify:track:bbb"}},
+			)
+			f.top["short_term"] = []string{"a", "bbb"}
+
+			runCLI(t, f.start(), append([]string{"playlist", "--fill", "--term", "short", "--retries", "0"}, tt.args...)...)
+
+			if got := f.playlist("short").uris; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("short term playlist = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFillDryRunEndToEnd(t *testing.T) {
+	f := newFakeServer(t,
+		&fakePlaylist{id: "short", name: "Favorite Short Term Tracks", owner: "me"},
+	)
+	f.top["short_term"] = []string{"a", "b"}
+	f.top["medium_term"] = []string{"c"}
+	f.top["long_term"] = []string{"d"}
+
+	out := runCLI(t, f.start(), "playlist", "--fill", "--dry-run", "--retries", "0")
+
+	if got := f.writes(); len(got) != 0 {
+		t.Errorf("writes = %q, want none", got)
+	}
+	for _, want := range []string{"dry run: would create Favorite Medium Term Tracks", "dry run: would add 2 tracks to Favorite Short Term Tracks"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%v", want, out)
+		}
+	}
+}
+
+func TestFillAppendNewOnlyJSONEndToEnd(t *testing.T) {
+	f := newFakeServer(t,
+		&fakePlaylist{id: "short", name: "Favorite Short Term Tracks", owner: "me", uris: trackURIs("a")},
+		&fakePlaylist{id: "medium", name: "Favorite Medium Term Tracks", owner: "me", uris: trackURIs("c")},
+		&fakePlaylist{id: "long", name: "Favorite Long Term Tracks", owner: "me", uris: trackURIs("d")},
+	)
+	f.top["short_term"] = []string{"a", "b"}
+	f.top["medium_term"] = []string{"c"}
+	f.top["long_term"] = []string{"d"}
+
+	out := runCLI(t, f.start(), "playlist", "--fill", "--append_new_only", "--format", "json")
+
+	var summary struct {
+		Playlists []playlistCounts `json:"playlists"`
+	}
+	if err := json.Unmarshal([]byte(out), &summary); err != nil {
+		t.Fatalf("output isn't the JSON summary: %v\n%v", err, out)
+	}
+	got := make(map[string][]string)
+	for _, p := range summary.Playlists {
+		got[p.Name] = p.Tracks
+	}
+	if tracks := got["Favorite Short Term Tracks"]; len(tracks) != 1 || !strings.Contains(tracks[0], "Song b") {
+		t.Errorf("Favorite Short Term Tracks tracks = %q, want just Song b", tracks)
+	}
+	if tracks := got["Favorite Medium Term Tracks"]; tracks != nil {
+		t.Errorf("Favorite Medium Term Tracks tracks = %q, want none", tracks)
+	}
+}
+
+func TestPurgeEndToEnd(t *testing.T) {
+	f := newFakeServer(t,
+		&fakePlaylist{id: "short", name: "Favorite Short Term Tracks", owner: "me", uris: append(trackURIs("a", "b"), "spotify:local:::song:180")},
+		&fakePlaylist{id: "medium", name: "Favorite Medium Term Tracks", owner: "me", uris: trackURIs("c")},
+		&fakePlaylist{id: "long", name: "Favorite Long Term Tracks", owner: "me", uris: trackURIs("d")},
+		&fakePlaylist{id: "mix", name: "Road Trip", owner: "me", uris: trackURIs("a")},
+	)
+
+	runCLI(t, f.start(), "playlist", "--purge_fav")
+
+	wantWrites := []string{
+		"DELETE /playlists/long/tracks",
+		"DELETE /playlists/medium/tracks",
+		"DELETE /playlists/short/tracks",
+		"DELETE /playlists/short/tracks",
+	}
+	if got := f.writes(); !reflect.DeepEqual(got, wantWrites) {
+		t.Errorf("writes = %q, want %q", got, wantWrites)
+	}
+	for _, id := range []string{"short", "medium", "long"} {
+		if got := f.playlist(id).uris; len(got) != 0 {
+			t.Errorf("playlist %v still has %q", id, got)
+		}
+	}
+	if got := f.playlist("mix").uris; !reflect.DeepEqual(got, trackURIs("a")) {
+		t.Errorf("Road Trip was changed to %q", got)
+	}
+}
+
+func TestFillDuplicateNamesEndToEnd(t *testing.T) {
+	f := newFakeServer(t,
+		&fakePlaylist{id: "theirs", name: "Favorite Short Term Tracks", owner: "someone", uris: trackURIs("x", "y")},
+		&fakePlaylist{id: "short", name: "Favorite Short Term Tracks", owner: "me"},
+		&fakePlaylist{id: "medium", name: "Favorite Medium Term Tracks", owner: "me"},
+		&fakePlaylist{id: "long", name: "Favorite Long Term Tracks", owner: "me"},
+	)
+	f.top["short_term"] = []string{"a"}
+	f.top["medium_term"] = []string{"b"}
+	f.top["long_term"] = []string{"c"}
+
+	runCLI(t, f.start(), "playlist", "--fill")
+
+	wantAdded := map[string][]string{
+		"short":  trackURIs("a"),
+		"medium": trackURIs("b"),
+		"long":   trackURIs("c"),
+	}
+	if !reflect.DeepEqual(f.added, wantAdded) {
+		t.Errorf("added = %q, want %q", f.added, wantAdded)
+	}
+}
+
+func TestFillMatchesNamesIgnoringCaseEndToEnd(t *testing.T) {
+	f := newFakeServer(t,
+		&fakePlaylist{id: "short", name: "favorite short term tracks", owner: "me"},
+		&fakePlaylist{id: "medium", name: "  FAVORITE MEDIUM TERM TRACKS ", owner: "me", uris: trackURIs("x")},
+		&fakePlaylist{id: "medium2", name: "Favorite Medium Term Tracks", owner: "me"},
+		&fakePlaylist{id: "long", name: "Favorite long term tracks", owner: "me"},
+	)
+	f.top["short_term"] = []string{"a"}
+	f.top["medium_term"] = []string{"b"}
+	f.top["long_term"] = []string{"c"}
+
+	runCLI(t, f.start(), "playlist", "--fill")
+
+	// medium and medium2 are the same playlist to the matchers, and medium has more
+	// tracks.
+	wantAdded := map[string][]string{
+		"short":  trackURIs("a"),
+		"medium": trackURIs("b"),
+		"long":   trackURIs("c"),
+	}
+	if !reflect.DeepEqual(f.added, wantAdded) {
+		t.Errorf("added = %q, want %q", f.added, wantAdded)
+	}
+}
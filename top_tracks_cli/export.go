@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// exportRow is one playlist item as written by --export.
+type exportRow struct {
+	// Type is "track", "local", or "episode".
+	Type    string     `json:"type"`
+	ID      spotify.ID `json:"id,omitempty"`
+	Name    string     `json:"name"`
+	Artists []string   `json:"artists"`
+	// Album is the show for episodes.
+	Album   string `json:"album"`
+	ISRC    string `json:"isrc,omitempty"`
+	AddedAt string `json:"added_at"`
+}
+
+// resolvePlaylist finds a playlist by URL, URI, ID, or name. Names are matched the way
+// the automated playlists are, ignoring case and surrounding whitespace, and a name
+// shared by several playlists resolves to the one preferredPlaylist picks.
+func resolvePlaylist(ctx context.Context, c spotifyAPI, user *spotify.PrivateUser, s string) (spotify.SimplePlaylist, error) {
+	playlists, err := allCurrentPlaylists(ctx, c)
+	if err != nil {
+		return spotify.SimplePlaylist{}, fmt.Errorf("allCurrentPlaylists(ctx): %v", err)
+	}
+	if id, err := parsePlaylistID(s); err == nil {
+		for _, v := range playlists {
+			if v.ID == id {
+				return v, nil
+			}
+		}
+		// Playlists the user doesn't follow can still be read by ID.
+		return spotify.SimplePlaylist{ID: id, Name: string(id)}, nil
+	}
+	key := strings.ToLower(strings.TrimSpace(s))
+	var found *spotify.SimplePlaylist
+	for _, v := range playlists {
+		if strings.ToLower(strings.TrimSpace(v.Name)) != key {
+			continue
+		}
+		if found != nil {
+			v = preferredPlaylist(user.ID, *found, v)
+		}
+		found = &v
+	}
+	if found == nil {
+		return spotify.SimplePlaylist{}, fmt.Errorf("no playlist is named %q", s)
+	}
+	return *found, nil
+}
+
+// exportRows converts playlist items for --export. Local files have no Spotify ID, and
+// items Spotify returns as null, e.g. unavailable in the market, are skipped.
+func exportRows(items []spotify.PlaylistItem) []exportRow {
+	rows := []exportRow{}
+	for _, v := range items {
+		switch {
+		case v.Track.Track != nil:
+			t := v.Track.Track
+			row := exportRow{Type: itemKind(v), ID: t.ID, Name: t.Name, Album: t.Album.Name, ISRC: t.ExternalIDs["isrc"], AddedAt: v.AddedAt}
+			if row.Type == "local" {
+				row.ID = ""
+			}
+			for _, a := range t.Artists {
+				row.Artists = append(row.Artists, a.Name)
+			}
+			rows = append(rows, row)
+		case v.Track.Episode != nil:
+			e := v.Track.Episode
+			rows = append(rows, exportRow{Type: "episode", ID: e.ID, Name: e.Name, Album: e.Show.Name, AddedAt: v.AddedAt})
+		}
+	}
+	return rows
+}
+
+// writeExport writes rows to w as "csv" or "json". CSV output has a header row and
+// joins artists with "; ".
+func writeExport(w io.Writer, rows []exportRow, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"type", "id", "name", "artists", "album", "isrc", "added_at"}); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if err := cw.Write([]string{r.Type, string(r.ID), r.Name, strings.Join(r.Artists, "; "), r.Album, r.ISRC, r.AddedAt}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
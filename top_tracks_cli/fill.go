@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+	"golang.org/x/sync/errgroup"
+)
+
+// runFill fills the automated playlists in set with the user's top tracks, following
+// the playlist command's flags, and returns the combined result. start is when the run
+// began, for --metrics_file.
+func runFill(ctx context.Context, client *spotify.Client, user *spotify.PrivateUser, set automatedSet, description string, limit int, seed int64, filter trackFilter, start time.Time) (fillResult, error) {
+	listStart := time.Now()
+	var automatedPlaylists []spotify.SimplePlaylist
+	var err error
+	if *playlistDated {
+		automatedPlaylists, err = createDatedPlaylists(ctx, client, user, set, description, time.Now(), *playlistDryRun)
+		if err != nil {
+			return fillResult{}, fmt.Errorf("createDatedPlaylists(ctx,client,%v): %v", redact(user.ID), err)
+		}
+	} else if automatedPlaylists, err = findAutomatedPlaylists(ctx, client, user, set, description); err != nil {
+		return fillResult{}, err
+	}
+	phases.since("list playlists", listStart)
+	configs := termConfigs(user, set, automatedPlaylists)
+	for i := range configs {
+		configs[i].maintainRank = *playlistMaintainRank
+		configs[i].sortFinal = *playlistSortFinal
+		configs[i].sortBy = *playlistSort
+		configs[i].dryRun = *playlistDryRun
+		configs[i].sample = *playlistSample
+		// Each term gets its own seed so the playlists aren't sampled identically.
+		configs[i].seed = seed + int64(i)
+		configs[i].limit = limit
+		configs[i].retries = *playlistRetries
+		configs[i].filter = filter
+		configs[i].replace = *playlistReplace
+		configs[i].minEnergy = *playlistMinEnergy
+		configs[i].minDanceability = *playlistMinDance
+		configs[i].recommend = *playlistRecommend
+		configs[i].recommendGenres = splitList(*playlistRecGenres)
+		if *playlistDescription != "" && configs[i].description != description {
+			configs[i].newDescription = description
+		}
+	}
+
+	var st *runState
+	if *playlistSinceSnapshot {
+		st, err = loadState()
+		if err != nil {
+			return fillResult{}, fmt.Errorf("loadState(): %v", err)
+		}
+		var changed []string
+		for _, cfg := range configs {
+			if prev, ok := st.Snapshots[string(cfg.id)]; ok && prev != cfg.snapshotID {
+				changed = append(changed, cfg.name)
+			}
+		}
+		if len(changed) > 0 {
+			fmt.Fprintf(textOut(), "These playlists were changed outside top_tracks_cli since the last fill: %v\n", strings.Join(changed, ", "))
+			if !confirm("Fill them anyway?") {
+				return fillResult{}, fmt.Errorf("nothing filled")
+			}
+		}
+	}
+
+	// With --atomic, everything is read up front so that a failed fetch aborts the
+	// run before any playlist is touched. Spotify has no transactions, so a write
+	// failing partway can still leave the playlists out of sync. --dedup-across-terms
+	// needs every term's tracks before any is filled, so it plans up front too.
+	planFirst := *playlistAtomic || *playlistDedupTerms
+	plans := make([]fillPlan, len(configs))
+	if planFirst {
+		g, gctx := errgroup.WithContext(ctx)
+		for i, cfg := range configs {
+			i, cfg := i, cfg
+			g.Go(func() error {
+				var err error
+				plans[i], err = planFill(gctx, client, cfg)
+				if err != nil {
+					return fmt.Errorf("planFill(ctx,client,%v): %v", cfg.name, err)
+				}
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return fillResult{}, fmt.Errorf("aborting fill before modifying any playlist: %v", err)
+		}
+	}
+	if *playlistDedupTerms {
+		priority, err := termPriority(*playlistTermPriority)
+		if err != nil {
+			return fillResult{}, err
+		}
+		if n := dedupAcrossTerms(configs, plans, priority); n > 0 {
+			slog.Info("dropped tracks already going to a higher priority term", "dropped", n)
+		}
+	}
+
+	// Every playlist is attempted even if another fails, and each one's outcome is
+	// reported once they've all returned.
+	results := make([]fillResult, len(configs))
+	fillErrs := make([]error, len(configs))
+	var g errgroup.Group
+	for i, cfg := range configs {
+		i, cfg := i, cfg
+		g.Go(func() error {
+			if planFirst {
+				results[i], fillErrs[i] = applyFill(ctx, client, cfg, plans[i])
+			} else {
+				results[i], fillErrs[i] = getTopTracksAndFill(ctx, client, cfg)
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	// Failures from here on are collected so the remaining bookkeeping still happens.
+	var total fillResult
+	var errs []string
+	var failedNames []string
+	for i, err := range fillErrs {
+		if err != nil {
+			failedNames = append(failedNames, configs[i].name)
+			report.fail(configs[i].name, err)
+		}
+	}
+	if len(failedNames) > 0 {
+		errs = append(errs, fmt.Sprintf("%d of %d playlists failed: %v", len(failedNames), len(configs), strings.Join(failedNames, ", ")))
+	}
+	for i, res := range results {
+		report.add(configs[i].name, func(rc *playlistCounts) {
+			rc.Added += res.added
+			rc.Skipped += res.skipped
+		})
+		total.added += res.added
+		total.skipped += res.skipped
+		total.failed += res.failed
+	}
+	if st != nil && !*playlistDryRun {
+		for _, cfg := range configs {
+			pl, err := client.GetPlaylist(ctx, cfg.id, spotify.Fields("snapshot_id"))
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("GetPlaylist(ctx,%v): %v", redact(string(cfg.id)), err))
+				continue
+			}
+			st.Snapshots[string(cfg.id)] = pl.SnapshotID
+		}
+		if err := saveState(st); err != nil {
+			errs = append(errs, fmt.Sprintf("saveState(): %v", err))
+		}
+	}
+	if *playlistAppendNewOnly && !*playlistDryRun {
+		for i, res := range results {
+			if len(res.addedTracks) == 0 {
+				continue
+			}
+			// With --format json the names go in the summary instead, even with --quiet.
+			if *playlistFormat == "json" {
+				report.add(configs[i].name, func(rc *playlistCounts) {
+					for _, name := range res.addedTracks {
+						rc.Tracks = append(rc.Tracks, redact(name))
+					}
+				})
+				continue
+			}
+			if *playlistQuiet {
+				continue
+			}
+			fmt.Fprintf(textOut(), "New in %v:\n", configs[i].name)
+			for _, name := range res.addedTracks {
+				fmt.Fprintf(textOut(), "  %v\n", redact(name))
+			}
+		}
+	}
+	// The summary table printed after the run has the counts in text mode. --watch
+	// only prints it once it stops, and with --format json these lines go to stderr
+	// next to the JSON on stdout, so both still get them. Failures are listed even
+	// with --quiet.
+	counts := !*playlistQuiet && (*playlistWatch || *playlistFormat == "json")
+	for i, cfg := range configs {
+		switch {
+		case fillErrs[i] != nil:
+			fmt.Fprintf(textOut(), "%v: failed: %v\n", cfg.name, fillErrs[i])
+		case counts:
+			fmt.Fprintf(textOut(), "%v: ok, %d added\n", cfg.name, results[i].added)
+		}
+	}
+	if counts {
+		verb := "Added"
+		if *playlistDryRun {
+			verb = "Would add"
+		}
+		fmt.Fprintf(textOut(), "%v %d tracks across %d playlists (%d skipped as duplicates, %d failed)\n", verb, total.added, len(configs), total.skipped, total.failed)
+	}
+	if !*playlistQuiet {
+		if limited, longest := pacer.limits(); limited > 0 {
+			fmt.Fprintf(textOut(), "Rate limited %d times, longest Retry-After %v\n", limited, longest)
+		}
+	}
+	if *playlistMetricsFile != "" && !*playlistDryRun {
+		limited, longest := pacer.limits()
+		stats := runStats{
+			tracksAdded:       total.added,
+			duplicatesSkipped: total.skipped,
+			apiCalls:          apiCounter.calls.Load(),
+			rateLimited:       limited,
+			longestRetryAfter: longest,
+			duration:          time.Since(start),
+			finished:          time.Now(),
+			phases:            phases,
+		}
+		if err := writeMetricsFile(*playlistMetricsFile, stats); err != nil {
+			errs = append(errs, fmt.Sprintf("writeMetricsFile(%v): %v", *playlistMetricsFile, err))
+		}
+	}
+	if len(errs) > 0 {
+		return total, fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return total, nil
+}
+
+// findAutomatedPlaylists returns the automated playlists of set, creating them if
+// needed. The IDs found are saved with the run state, and later runs reuse them while
+// they're still valid instead of listing all the user's playlists. The cache is only an
+// optimization: if it can't be read or written, the playlists are listed as before.
+func findAutomatedPlaylists(ctx context.Context, client *spotify.Client, user *spotify.PrivateUser, set automatedSet, description string) ([]spotify.SimplePlaylist, error) {
+	st, err := loadState()
+	if err != nil {
+		slog.Warn("couldn't read the playlist ID cache", "err", err)
+	} else if found, ok := cachedAutomatedPlaylists(ctx, client, user, set, st); ok {
+		slog.Debug("using cached playlist IDs", "source", set.source)
+		return found, nil
+	}
+	allUsersPlaylists, err := allCurrentPlaylists(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get user playlists: %v", err)
+	}
+	found, err := getAutomatedPlaylists(ctx, client, user, set, allUsersPlaylists, description, *playlistDryRun)
+	if err != nil {
+		return nil, fmt.Errorf("getAutomatedPlaylists(ctx,client,%v): %v", redact(user.ID), err)
+	}
+	if st != nil && !*playlistDryRun {
+		cacheAutomatedPlaylists(user, set, found, st)
+		if err := saveState(st); err != nil {
+			slog.Warn("couldn't save the playlist ID cache", "err", err)
+		}
+	}
+	return found, nil
+}
+
+// watchFill runs runFill now and then every --interval until the process is interrupted.
+// A failed run is logged and the next one still happens. The client refreshes its
+// token as needed, so only the first run can need a browser login. --timeout applies
+// to each run.
+func watchFill(ctx context.Context, client *spotify.Client, user *spotify.PrivateUser, set automatedSet, description string, limit int, filter trackFilter) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for {
+		runStart := time.Now()
+		slog.Info("starting fill", "playlists", len(set.names))
+		runCtx, cancel := ctx, context.CancelFunc(func() {})
+		if *timeout > 0 {
+			runCtx, cancel = runTimeout.start(ctx, *timeout)
+		}
+		// The counts, metrics, and summary are per run, not since --watch started.
+		apiCounter.calls.Store(0)
+		pacer.resetLimits()
+		phases.reset()
+		report.reset()
+		// Without --seed each run samples differently.
+		seed := *playlistSeed
+		if seed == 0 {
+			seed = runStart.UnixNano()
+		}
+		res, err := runFill(runCtx, client, user, set, description, limit, seed, filter, runStart)
+		cancel()
+		if err != nil {
+			slog.Error("fill failed", "added", res.added, "err", err)
+		} else {
+			slog.Info("fill finished", "added", res.added, "skipped", res.skipped, "failed", res.failed, "elapsed", time.Since(runStart).Truncate(time.Millisecond))
+		}
+
+		next := time.NewTimer(*playlistInterval)
+		slog.Info("waiting for the next fill", "at", runStart.Add(*playlistInterval).Format(time.DateTime))
+		select {
+		case <-ctx.Done():
+			next.Stop()
+			slog.Info("interrupted, stopping --watch")
+			return
+		case <-next.C:
+		}
+	}
+}
+
+// termPriority parses a comma-separated list of term names, highest priority first.
+// Every term must be listed exactly once.
+func termPriority(s string) ([]spotify.Range, error) {
+	names := splitList(s)
+	if len(names) != len(terms) {
+		return nil, fmt.Errorf("--term-priority %q must list short, medium, and long once each", s)
+	}
+	var order []spotify.Range
+	seen := make(map[spotify.Range]bool)
+	for _, name := range names {
+		r, err := termRange(name)
+		if err != nil {
+			return nil, err
+		}
+		if seen[r] {
+			return nil, fmt.Errorf("--term-priority %q lists %v twice", s, name)
+		}
+		seen[r] = true
+		order = append(order, r)
+	}
+	return order, nil
+}
+
+// dedupAcrossTerms removes from each plan the tracks that a higher priority term's plan
+// already adds, so every track lands on one playlist only, and returns how many were
+// removed. plans[i] is the plan for configs[i].
+func dedupAcrossTerms(configs []playlistConfig, plans []fillPlan, priority []spotify.Range) int {
+	claimed := make(map[spotify.ID]bool)
+	dropped := 0
+	for _, r := range priority {
+		for i, cfg := range configs {
+			if cfg.duration != r || plans[i].tracks == nil {
+				continue
+			}
+			kept := *plans[i].tracks
+			kept.Tracks = nil
+			for _, t := range plans[i].tracks.Tracks {
+				if claimed[t.ID] {
+					dropped++
+					continue
+				}
+				claimed[t.ID] = true
+				kept.Tracks = append(kept.Tracks, t)
+			}
+			plans[i].tracks = &kept
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func trackPage(ids ...string) *spotify.FullTrackPage {
+	page := &spotify.FullTrackPage{}
+	for _, id := range ids {
+		var t spotify.FullTrack
+		t.ID = spotify.ID(id)
+		page.Tracks = append(page.Tracks, t)
+	}
+	return page
+}
+
+func pageIDs(page *spotify.FullTrackPage) []string {
+	if page == nil {
+		return nil
+	}
+	var ids []string
+	for _, t := range page.Tracks {
+		ids = append(ids, string(t.ID))
+	}
+	return ids
+}
+
+func TestDedupAcrossTerms(t *testing.T) {
+	configs := []playlistConfig{
+		{duration: spotify.ShortTermRange},
+		{duration: spotify.MediumTermRange},
+		{duration: spotify.LongTermRange},
+	}
+	tests := []struct {
+		name        string
+		priority    string
+		tracks      [][]string
+		want        [][]string
+		wantDropped int
+	}{
+		{
+			name:     "no overlap",
+			priority: "short,medium,long",
+			tracks:   [][]string{{"a"}, {"b"}, {"c"}},
+			want:     [][]string{{"a"}, {"b"}, {"c"}},
+		},
+		{
+			name:        "short term claims first",
+			priority:    "short,medium,long",
+			tracks:      [][]string{{"a", "b"}, {"b", "c"}, {"a", "c", "d"}},
+			want:        [][]string{{"a", "b"}, {"c"}, {"d"}},
+			wantDropped: 3,
+		},
+		{
+			name:        "long term claims first",
+			priority:    "long,medium,short",
+			tracks:      [][]string{{"a", "b"}, {"b", "c"}, {"a", "c", "d"}},
+			want:        [][]string{nil, {"b"}, {"a", "c", "d"}},
+			wantDropped: 3,
+		},
+		{
+			name:        "every track claimed",
+			priority:    "short,medium,long",
+			tracks:      [][]string{{"a", "b"}, {"a", "b"}, {"b"}},
+			want:        [][]string{{"a", "b"}, nil, nil},
+			wantDropped: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			priority, err := termPriority(tt.priority)
+			if err != nil {
+				t.Fatalf("termPriority(%q) error = %v", tt.priority, err)
+			}
+			plans := make([]fillPlan, len(tt.tracks))
+			for i, ids := range tt.tracks {
+				plans[i].tracks = trackPage(ids...)
+			}
+			if got := dedupAcrossTerms(configs, plans, priority); got != tt.wantDropped {
+				t.Errorf("dedupAcrossTerms() = %d, want %d", got, tt.wantDropped)
+			}
+			for i, plan := range plans {
+				if got := pageIDs(plan.tracks); !reflect.DeepEqual(got, tt.want[i]) {
+					t.Errorf("plan %d tracks = %q, want %q", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTermPriority(t *testing.T) {
+	for _, s := range []string{"", "short,medium", "short,short,long", "short,medium,long,short", "short,medium,forever"} {
+		if _, err := termPriority(s); err == nil {
+			t.Errorf("termPriority(%q) = nil error, want an error", s)
+		}
+	}
+	got, err := termPriority("long, short,medium")
+	if err != nil {
+		t.Fatalf("termPriority() error = %v", err)
+	}
+	want := []spotify.Range{spotify.LongTermRange, spotify.ShortTermRange, spotify.MediumTermRange}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("termPriority() = %v, want %v", got, want)
+	}
+}
+
+func TestSampleTracks(t *testing.T) {
+	page := trackPage("a", "b", "c", "d")
+	if got := sampleTracks(page, "p", 2, 1); len(got.Tracks) != 2 {
+		t.Errorf("sampleTracks(n=2) = %v, want 2 tracks", pageIDs(got))
+	}
+	// More than the filters left is capped at what's there instead of failing.
+	if got := sampleTracks(page, "p", 10, 1); !reflect.DeepEqual(pageIDs(got), pageIDs(page)) {
+		t.Errorf("sampleTracks(n=10) = %v, want %v", pageIDs(got), pageIDs(page))
+	}
+}
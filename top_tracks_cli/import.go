@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// importRow is one entry of a file read by --import. Rows are resolved by id, else isrc,
+// else name and artists.
+type importRow struct {
+	// line is the row's line in a CSV file, or its index in a JSON array, for messages.
+	line    int
+	kind    string
+	id      string
+	isrc    string
+	name    string
+	artists []string
+}
+
+// readImport reads the rows of a file written by --export. JSON files, by extension,
+// hold an array of objects; anything else is read as CSV with a header row. Only the
+// id, isrc, name, and artists columns are used, and any of them may be missing; an
+// artists column holds names separated by ";".
+func readImport(path string) ([]importRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var entries []exportRow
+		if err := json.NewDecoder(f).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("json.Decode(%v): %v", path, err)
+		}
+		rows := make([]importRow, 0, len(entries))
+		for i, e := range entries {
+			rows = append(rows, importRow{line: i + 1, kind: e.Type, id: string(e.ID), isrc: e.ISRC, name: e.Name, artists: e.Artists})
+		}
+		return rows, nil
+	}
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading the header of %v: %v", path, err)
+	}
+	col := make(map[string]int)
+	for i, h := range header {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	field := func(record []string, name string) string {
+		i, ok := col[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	var rows []importRow
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", path, line, err)
+		}
+		rows = append(rows, importRow{
+			line:    line,
+			kind:    field(record, "type"),
+			id:      field(record, "id"),
+			isrc:    field(record, "isrc"),
+			name:    field(record, "name"),
+			artists: splitList(strings.ReplaceAll(field(record, "artists"), ";", ",")),
+		})
+	}
+}
+
+// resolveImportRow returns the Spotify track for row. Rows without an ID are searched
+// for by ISRC, then by name and artists, taking the top match; a name with no artists
+// may be written "artist - title".
+func resolveImportRow(ctx context.Context, c *spotify.Client, row importRow, market string) (spotify.ID, error) {
+	switch row.kind {
+	case "local":
+		return "", fmt.Errorf("local files can't be added by the Web API")
+	case "episode":
+		return "", fmt.Errorf("episodes can't be imported, only tracks")
+	}
+	if row.id != "" {
+		return parseID("track", row.id)
+	}
+	var query string
+	switch {
+	case row.isrc != "":
+		query = "isrc:" + row.isrc
+	case row.name != "":
+		name, artists := row.name, row.artists
+		if len(artists) == 0 {
+			if a, t, ok := strings.Cut(name, " - "); ok {
+				name, artists = t, []string{a}
+			}
+		}
+		query = fmt.Sprintf("track:%q", name)
+		if len(artists) > 0 {
+			query += fmt.Sprintf(" artist:%q", artists[0])
+		}
+	default:
+		return "", fmt.Errorf("row has no id, isrc, or name")
+	}
+	found, err := searchTracks(ctx, c, query, 1, market, trackFilter{})
+	if err != nil {
+		return "", err
+	}
+	if len(found.Tracks) == 0 {
+		return "", fmt.Errorf("no track matches %v", query)
+	}
+	return found.Tracks[0].ID, nil
+}
+
+// importPlaylist creates a playlist called name from the tracks in the file at path. It
+// returns how many tracks were added and how many rows couldn't be resolved; each of
+// those is logged so the file can be fixed.
+func importPlaylist(ctx context.Context, c *spotify.Client, user *spotify.PrivateUser, path, name, description string) (int, int, error) {
+	rows, err := readImport(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("readImport(%v): %v", path, err)
+	}
+	var ids []spotify.ID
+	unresolved := 0
+	for _, row := range rows {
+		id, err := resolveImportRow(ctx, c, row, user.Country)
+		if err != nil {
+			slog.Warn("couldn't resolve import row", "file", path, "line", row.line, "err", err)
+			unresolved++
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return 0, unresolved, fmt.Errorf("none of the %d rows in %v resolved to a track", len(rows), path)
+	}
+	pl, err := c.CreatePlaylistForUser(ctx, user.ID, name, description, false, false)
+	if err != nil {
+		return 0, unresolved, fmt.Errorf("CreatePlaylistForUser(ctx,%v,%v,%v,false,false): %v", redact(user.ID), name, description, err)
+	}
+	if err := addTracks(ctx, c, pl.ID, ids); err != nil {
+		return 0, unresolved, err
+	}
+	return len(ids), unresolved, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// setupLogging sends log messages at level and above to stderr, leaving stdout to the
+// command's results.
+func setupLogging(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown --log-level %q, want debug, info, warn, or error", level)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: l})))
+	return nil
+}
+
+// logRetry is the backoff.Notify used for Spotify calls, logging each failed attempt.
+func logRetry(err error, next time.Duration) {
+	slog.Debug("retrying Spotify call", "err", err, "in", next)
+}
+
+// logProgress logs a progress message at info level with --progress, else at debug.
+func logProgress(ctx context.Context, msg string, args ...any) {
+	level := slog.LevelDebug
+	if *progress {
+		level = slog.LevelInfo
+	}
+	slog.Log(ctx, level, msg, args...)
+}
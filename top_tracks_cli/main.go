@@ -4,8 +4,37 @@ top_tracks_cli is a CLI tool that generates three playlists of the user's recent
 Usage:
 
 	main.exe playlist --fill      // Fills up the 'Favorite * Term Tracks' playlists
+	main.exe playlist --fill --watch --interval 168h // Refills the playlists weekly until interrupted
+	main.exe playlist --fill --recommend 20 // Also adds 20 tracks recommended from the top tracks
+	main.exe playlist --fill --name-suffix {2006-01} // Fills this month's snapshot playlists, e.g. 'Favorite Short Term Tracks 2024-06'
 	main.exe playlist --purge_fav // Purges songs from the 'Favorite * Term Tracks' playlists
+	main.exe playlist --purge_dupes // Removes repeated tracks from the 'Favorite * Term Tracks' playlists
 	main.exe playlist --list_all  // Lists all the user's playlists
+	main.exe playlist --delete    // Removes the 'Favorite * Term Tracks' playlists from the library
+	main.exe playlist --export "Favorite Short Term Tracks" --format json // Backs up a playlist's items to a file
+	main.exe playlist --import backup.csv --name "Restored" // Creates a playlist from an exported or hand-written file
+	main.exe follow --playlist <id|url> // Follows the given playlist
+	main.exe refresh --threshold 0.5 // Refills only the 'Favorite * Term Tracks' playlists that have gone stale
+	main.exe unfollow --pattern <regex> // Unfollows every playlist whose name matches the pattern
+	main.exe fill_search --query "genre:jazz year:2020" --playlist Jazz // Fills a playlist from a search
+	main.exe genres --term long --top 10 // Prints your top genres, tallied from your top artists
+	main.exe duplicates --resolve // Lists playlists sharing a name and unfollows the extras you pick
+	main.exe --profile work playlist --fill // Uses the work account's cached login instead of the default one
+	main.exe check_token --token_file <path> // Checks a saved token without opening a browser
+	main.exe token_scopes --token_file <path> // Lists a saved token's scopes and any this version needs
+	main.exe export_m3u --term medium --out favorites.m3u // Writes top tracks to an extended M3U file
+	main.exe top --term all       // Prints the user's top tracks for each term
+	main.exe compare --playlist <id|url> --term medium // Compares top tracks against a playlist
+	main.exe items --playlist <id|url> --min_popularity 50 // Lists a playlist's tracks matching filters
+	main.exe last_updated         // Shows when each 'Favorite * Term Tracks' playlist last had a track added
+	main.exe workout --target_energy 0.9 --target_tempo 150 // Rebuilds a playlist from recommendations steered by audio features
+	main.exe archive --term short --to "Spring 2024" // Copies top tracks into a new playlist that's never refilled
+	main.exe custom --term-range long --playlist-name "Old Faithfuls" --limit 30 // Fills one playlist of your choosing with top tracks
+	main.exe audit --playlist <id|url> --remove // Reports, and optionally removes, unplayable tracks
+	main.exe like_top --term medium // Saves top tracks to Liked Songs
+	main.exe split --playlist <id|url> --size 100 --prefix Part // Splits a playlist into numbered smaller ones
+	main.exe show_queue           // Shows the currently playing track and the playback queue
+	main.exe recent_adds --since 72h // Lists tracks added to your playlists recently, newest first
 
 From the test-branch.
 */
@@ -13,55 +42,298 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/cenkalti/backoff"
 	"github.com/zmb3/spotify/v2"
-	"log"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"regexp"
 	"runtime"
-	"sync"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	spotifyauth "github.com/zmb3/spotify/v2/auth"
 	time2 "time"
 )
 
-// redirectURI is the OAuth redirect URI for the application.
-// You must register an application at Spotify's developer portal
-// and enter this value.
-const redirectURI = "http://localhost:8080/callback"
+// defaultDescription is the description given to the automated playlists when they're
+// created, unless --description is set.
+const defaultDescription = "automated from top_tracks_cli"
+
+// maxDescriptionLength is the longest playlist description Spotify accepts.
+const maxDescriptionLength = 300
+
+// currentUserRetries is how many times the CurrentUser call after login is retried.
+const currentUserRetries = 5
+
+// maxTopTracks is the most top tracks Spotify returns in a single request, and the
+// default number fetched per term.
+const maxTopTracks = 50
+
+// maxTopTracksTotal is the most top tracks Spotify returns for a single term across
+// pages: the endpoint accepts offsets up to 49 with pages of 50.
+const maxTopTracksTotal = 99
+
+// The OAuth redirect URI for the application is built from these, or from --port and
+// --callback-path. You must register an application at Spotify's developer portal and
+// enter the resulting URI, http://localhost:8080/callback by default.
+const (
+	defaultPort         = 8080
+	defaultCallbackPath = "/callback"
+)
+
+// defaultProfile is the --profile used unless another is given.
+const defaultProfile = "default"
+
+// redirectURL returns the OAuth redirect URI for the login callback server.
+func redirectURL(port int, path string) string {
+	return fmt.Sprintf("http://localhost:%d%v", port, path)
+}
+
+// newAuthenticator returns the authenticator for the given redirect URI. In PKCE mode
+// it has no client secret, so token exchanges and refreshes send just the client ID.
+func newAuthenticator(redirect string) *spotifyauth.Authenticator {
+	secret := clientSecret
+	if pkceMode() {
+		secret = ""
+	}
+	return spotifyauth.New(
+		spotifyauth.WithRedirectURL(redirect),
+		spotifyauth.WithScopes(requiredScopes...),
+		spotifyauth.WithClientSecret(secret),
+		spotifyauth.WithClientID(clientID),
+	)
+}
+
+// pkceMode reports whether to log in with PKCE instead of the client secret: when
+// --pkce is given or spotify_secret is unset.
+func pkceMode() bool {
+	return *pkce || clientSecret == ""
+}
+
+// credentialsHelp explains where the app credentials come from, for new users.
+const credentialsHelp = `Create an app at https://developer.spotify.com/dashboard, add the redirect URI
+(http://localhost:8080/callback by default) under its settings, and copy its Client ID
+into spotify_clientID. spotify_secret is optional: without it, login uses PKCE.`
+
+// checkCredentials returns an error naming the environment variables that must be set
+// before logging in. An unset spotify_secret is fine, as login then uses PKCE.
+func checkCredentials() error {
+	if strings.TrimSpace(clientID) == "" {
+		return fmt.Errorf("spotify_clientID isn't set.\n%v", credentialsHelp)
+	}
+	if clientSecret != "" && strings.TrimSpace(clientSecret) == "" {
+		return fmt.Errorf("spotify_secret is set but blank; set it to the app's Client secret or unset it to log in with PKCE.\n%v", credentialsHelp)
+	}
+	return nil
+}
+
+// requiredScopes are the scopes the tool asks for when logging in.
+var requiredScopes = []string{
+	spotifyauth.ScopeUserReadPrivate,
+	spotifyauth.ScopeUserTopRead,
+	spotifyauth.ScopePlaylistModifyPrivate,
+	spotifyauth.ScopePlaylistModifyPublic,
+	spotifyauth.ScopePlaylistReadPrivate,
+	spotifyauth.ScopeUserReadPlaybackState,
+	spotifyauth.ScopeUserLibraryRead,
+	spotifyauth.ScopeUserLibraryModify,
+}
 
 var (
 	clientID     = os.Getenv("spotify_clientID")
 	clientSecret = os.Getenv("spotify_secret")
-	state        = os.Getenv("spotify_state")
-	auth         = spotifyauth.New(
-		spotifyauth.WithRedirectURL(redirectURI),
-		spotifyauth.WithScopes(
-			spotifyauth.ScopeUserReadPrivate,
-			spotifyauth.ScopeUserTopRead,
-			spotifyauth.ScopePlaylistModifyPrivate,
-			spotifyauth.ScopePlaylistReadPrivate,
-		),
-		spotifyauth.WithClientSecret(clientSecret),
-		spotifyauth.WithClientID(clientID),
-	)
-	ch = make(chan *spotify.Client)
+	// auth is rebuilt in main once --port and --callback-path are known.
+	auth = newAuthenticator(redirectURL(defaultPort, defaultCallbackPath))
+	ch   = make(chan *spotify.Client)
+	// errCh carries login failures from the callback handler and server back to main.
+	errCh = make(chan error)
 
 	// regex
-	shortTermRe = regexp.MustCompile("^Favorite Short Term Tracks$")
-	medTermRe   = regexp.MustCompile("^Favorite Medium Term Tracks$")
-	longTermRe  = regexp.MustCompile("^Favorite Long Term Tracks$")
-	plMatch     = regexp.MustCompile("^Favorite (Short|Medium|Long) Term Tracks$")
+	// The playlist matchers ignore case and surrounding whitespace, so a renamed
+	// "favorite short term tracks " is still found instead of getting a duplicate.
+	shortTermRe = regexp.MustCompile("(?i)^\\s*Favorite Short Term Tracks( \\d{4}-\\d{2})?\\s*$")
+	medTermRe   = regexp.MustCompile("(?i)^\\s*Favorite Medium Term Tracks( \\d{4}-\\d{2})?\\s*$")
+	longTermRe  = regexp.MustCompile("(?i)^\\s*Favorite Long Term Tracks( \\d{4}-\\d{2})?\\s*$")
+	plMatch     = regexp.MustCompile("(?i)^\\s*Favorite (Short|Medium|Long) Term Tracks\\s*$")
+	// plMatchDated also matches the playlists created by --dated, e.g. "Favorite Short Term Tracks 2024-06".
+	plMatchDated = regexp.MustCompile("(?i)^\\s*Favorite (Short|Medium|Long) Term Tracks( \\d{4}-\\d{2})?\\s*$")
+	spotifyURL   = regexp.MustCompile("^https?://open\\.spotify\\.com/(?:[a-z-]+/)?(album|artist|episode|playlist|show|track)/([^/?#]+)")
+	spotifyURI   = regexp.MustCompile("^spotify:(?:user:[^:]+:)?(album|artist|episode|playlist|show|track):(.+)$")
+	spotifyID    = regexp.MustCompile("^[0-9A-Za-z]{22}$")
+
+	// The --by-artist playlists, e.g. "Favorite Short Term Artists".
+	shortTermArtistsRe = regexp.MustCompile("(?i)^\\s*Favorite Short Term Artists( \\d{4}-\\d{2})?\\s*$")
+	medTermArtistsRe   = regexp.MustCompile("(?i)^\\s*Favorite Medium Term Artists( \\d{4}-\\d{2})?\\s*$")
+	longTermArtistsRe  = regexp.MustCompile("(?i)^\\s*Favorite Long Term Artists( \\d{4}-\\d{2})?\\s*$")
+	plMatchArtists     = regexp.MustCompile("(?i)^\\s*Favorite (Short|Medium|Long) Term Artists\\s*$")
+	// plMatchArtistsDated also matches the artist playlists created by --dated.
+	plMatchArtistsDated = regexp.MustCompile("(?i)^\\s*Favorite (Short|Medium|Long) Term Artists( \\d{4}-\\d{2})?\\s*$")
+
+	// apiBase points the client at a different Spotify Web API, e.g. a fake server for
+	// end-to-end tests. When set the browser auth flow is skipped. It's left out of the
+	// usage output on purpose.
+	apiBase = flag.String("api_base", "", "")
+
+	userAgent     = flag.String("user_agent", "top_tracks_cli/"+version+" (+https://github.com/dduclayan/spotify_v3)", "User-Agent header sent with Spotify API requests")
+	profilePhases = flag.Bool("profile_phases", false, "print how long each phase of the run took")
+	showLimits    = flag.Bool("show_limits", false, "print how often Spotify rate limited the run and the longest Retry-After it asked for")
+	redactOutput  = flag.Bool("redact", false, "replace user IDs, playlist IDs, and track names in the output with stable hashes, for sharing logs")
+	httpTimeout   = flag.Duration("http_timeout", 30*time2.Second, "timeout for each HTTP request to Spotify, including the token exchange; 0 means none")
+	reauth        = flag.Bool("reauth", false, "log in through the browser even if a cached login token exists")
+	authPort      = flag.Int("port", defaultPort, "local port for the login callback server")
+	callbackPath  = flag.String("callback-path", defaultCallbackPath, "URL path of the login callback")
+	authTimeout   = flag.Duration("auth_timeout", 5*time2.Minute, "how long to wait for the browser login to complete")
+	timeout       = flag.Duration("timeout", 2*time2.Minute, "give up on the Spotify calls after this long, not counting the browser login or time spent at prompts; 0 means no limit")
+	progress      = flag.Bool("progress", false, "log progress while filling playlists, which is otherwise only logged at --log-level debug")
+	pkce          = flag.Bool("pkce", false, "log in with PKCE, without the client secret; the default when spotify_secret is unset")
+	logLevel      = flag.String("log-level", "info", "log messages at this level and above to stderr: debug, info, warn, or error")
+	profile       = flag.String("profile", defaultProfile, "name of the account whose cached login and state to use, so several accounts can be switched between")
+	retryTimeout  = flag.Duration("retry-timeout", 30*time2.Second, "stop retrying a failing Spotify call after this long; 0 means only --retries limits it")
+	configFile    = flag.String("config", "", "JSON file naming the short, medium, and long term playlists and setting their description, public, and collaborative flags")
 
 	// command flags
 	playlistCmd            = flag.NewFlagSet("playlist", flag.ExitOnError)
 	playlistList           = playlistCmd.Bool("list_all", false, "list all playlists for current user")
+	playlistFormat         = playlistCmd.String("format", "text", "output format for --list_all and the summary after fills and purges: text or json; for --export: csv (the default there) or json")
+	playlistOwnedOnly      = playlistCmd.Bool("owned_only", false, "with --list_all, show only playlists you own")
+	playlistCollabOnly     = playlistCmd.Bool("collaborative_only", false, "with --list_all, show only collaborative playlists")
+	playlistNonCollab      = playlistCmd.Bool("non_collaborative", false, "with --list_all, show only playlists that aren't collaborative")
+	playlistFastPurge      = playlistCmd.Bool("fast_purge", false, "with --purge_fav, clear each playlist in one call instead of removing its items")
+	playlistDryRun         = playlistCmd.Bool("dry-run", false, "with --fill, --purge_fav, or --purge_dupes, print the tracks that would be added or removed without changing any playlist")
 	playlistPurgeFavTracks = playlistCmd.Bool("purge_fav", false, "purge all tracks in \"Favorite short/med/long Term Tracks\"")
+	playlistPurgeDupes     = playlistCmd.Bool("purge_dupes", false, "remove repeated tracks from the automated playlists, keeping the first of each")
 	playlistFill           = playlistCmd.Bool("fill", false, "fill playlists with favorite tracks")
+	playlistByArtist       = playlistCmd.Bool("by-artist", false, "with --fill or --purge_fav, use the \"Favorite * Term Artists\" playlists, filled with your top artists' top tracks")
+	playlistDated          = playlistCmd.Bool("dated", false, "with --fill, create new playlists suffixed with the current month instead of refilling the existing ones")
+	playlistLimit          = playlistCmd.Int("limit", maxTopTracks, "number of top tracks to fill each playlist with, fetched in pages past 50, up to 99")
+	playlistCount          = playlistCmd.Int("count", maxTopTracks, "same as --limit, but capped at 99 with a warning instead of failing")
+	playlistClampLimit     = playlistCmd.Bool("clamp_limit", false, "cap --limit at the most Spotify returns with a warning, instead of failing")
+	playlistDescription    = playlistCmd.String("description", "", "description to set on the playlists filled by --fill or created by --import")
+	playlistRetries        = playlistCmd.Int("retries", -1, "maximum retries per Spotify call in --fill and --purge_fav; 0 disables retries, negative retries until the backoff gives up")
+	playlistMinDuration    = playlistCmd.Int("min_duration", 0, "skip top tracks shorter than this many seconds")
+	playlistMaxDuration    = playlistCmd.Int("max_duration", 0, "skip top tracks longer than this many seconds; 0 means no limit")
+	playlistAtomic         = playlistCmd.Bool("atomic", false, "with --fill, fetch everything for all playlists before changing any, so a failed fetch leaves them untouched")
+	playlistSinceSnapshot  = playlistCmd.Bool("since_snapshot", false, "with --fill, warn before overwriting playlists changed outside the tool since the last fill")
+	playlistQuiet          = playlistCmd.Bool("quiet", false, "suppress the summary printed after --fill")
+	playlistEpisodes       = playlistCmd.Bool("episodes", false, "include podcast episodes when reading playlist items")
+	playlistAppendNewOnly  = playlistCmd.Bool("append_new_only", false, "list the tracks each playlist gained; tracks already on a playlist are always skipped")
+	playlistSample         = playlistCmd.Int("sample", 0, "with --fill, fill each playlist with this many tracks picked at random from its filtered top tracks; 0 uses them all")
+	playlistSeed           = playlistCmd.Int64("seed", 0, "random seed for --sample, for reproducible picks; 0 picks a new seed each run")
+	playlistSort           = playlistCmd.String("sort", "rank", "order to add the top tracks in with --fill: rank keeps Spotify's ranking; popularity, release (newest first), or name")
+	playlistSortFinal      = playlistCmd.String("sort_final", "", "reorder each playlist after --fill by popularity, release_date, duration, or tempo")
+	playlistMaintainRank   = playlistCmd.Bool("maintain_rank", false, "reorder each playlist to match the top-tracks ranking after --fill")
+	playlistExclude        = playlistCmd.String("exclude", "", "with --fill, comma-separated artist names (any case) and track IDs, URIs, or URLs to leave out")
+	playlistMarket         = playlistCmd.String("market", "from_token", "with --fill, skip top tracks that can't be played in this ISO 3166-1 alpha-2 country; from_token uses your account's country, empty keeps them all")
+	playlistExport         = playlistCmd.String("export", "", "write the items of this playlist, given by name, ID, or URL, to --out")
+	playlistOut            = playlistCmd.String("out", "", "file written by --export; defaults to the playlist name with the format's extension")
+	playlistPublic         = playlistCmd.Bool("public", false, "create missing automated playlists as public")
+	playlistCollaborative  = playlistCmd.Bool("collaborative", false, "create missing automated playlists as collaborative; Spotify requires them to be private")
+	playlistSetVisibility  = playlistCmd.Bool("update-visibility", false, "make the existing automated playlists public or private to match --public")
+	playlistTerm           = playlistCmd.String("term", "all", "limit --fill and --purge_fav to one term's playlist: short, medium, long, or all")
+	playlistReplace        = playlistCmd.Bool("replace", false, "with --fill, set each playlist to exactly the current top tracks in one call instead of adding the new ones")
+	playlistVerbose        = playlistCmd.Bool("verbose", false, "with --list_all, also show track counts and owners, and the top artists on each automated playlist")
+	playlistDelete         = playlistCmd.Bool("delete", false, "remove the automated playlists, including --dated ones, from your library")
+	playlistConfirm        = playlistCmd.Bool("confirm", false, "with --delete, don't ask before removing the playlists")
+	playlistDedupTerms     = playlistCmd.Bool("dedup-across-terms", false, "with --fill, put each track on only the highest priority term's playlist, see --term-priority")
+	playlistTermPriority   = playlistCmd.String("term-priority", "short,medium,long", "order in which terms claim tracks with --dedup-across-terms, highest first")
+	playlistMinEnergy      = playlistCmd.Float64("min-energy", 0, "with --fill, skip top tracks whose Spotify energy is below this, from 0 to 1")
+	playlistMinDance       = playlistCmd.Float64("min-danceability", 0, "with --fill, skip top tracks whose Spotify danceability is below this, from 0 to 1")
+	playlistRecommend      = playlistCmd.Int("recommend", 0, "with --fill, also add up to this many tracks recommended from the top 5 tracks, at most 100; 0 adds none")
+	playlistRecGenres      = playlistCmd.String("recommend-genres", "", "comma-separated genres to seed --recommend with too; each one replaces a seed track, as Spotify takes 5 seeds")
+	playlistOlderThan      = playlistCmd.Duration("older-than", 0, "with --purge_fav, only remove items added longer ago than this, e.g. 720h; 0 removes them all")
+	playlistNameSuffix     = playlistCmd.String("name-suffix", "", "fill and purge the automated playlists named with this suffix, e.g. {2006-01} for one per month; {...} is a Go time layout")
+	playlistImport         = playlistCmd.String("import", "", "create a playlist from the tracks in this CSV or JSON file, e.g. one written by --export")
+	playlistName           = playlistCmd.String("name", "", "name of the playlist created by --import")
+	playlistWatch          = playlistCmd.Bool("watch", false, "with --fill, keep running and refill the playlists every --interval until interrupted")
+	playlistInterval       = playlistCmd.Duration("interval", 7*24*time2.Hour, "time between fills in --watch mode")
+	playlistMetricsFile    = playlistCmd.String("metrics_file", "", "write --fill stats to this file in Prometheus textfile format")
+	followCmd              = flag.NewFlagSet("follow", flag.ExitOnError)
+	followPlaylist         = followCmd.String("playlist", "", "ID, URI, or URL of the playlist to follow")
+	followPublic           = followCmd.Bool("public", true, "show the followed playlist on your public profile")
+	lastUpdatedCmd         = flag.NewFlagSet("last_updated", flag.ExitOnError)
+	workoutCmd             = flag.NewFlagSet("workout", flag.ExitOnError)
+	workoutName            = workoutCmd.String("name", "Workout", "name of the playlist to rebuild, created if missing")
+	workoutTerm            = workoutCmd.String("term", "short", "term of top tracks used as seeds: short, medium, or long")
+	workoutLimit           = workoutCmd.Int("limit", 50, "number of tracks to put on the playlist (1-100)")
+	workoutEnergy          = workoutCmd.Float64("target_energy", -1, "target energy, 0-1")
+	workoutDanceability    = workoutCmd.Float64("target_danceability", -1, "target danceability, 0-1")
+	workoutValence         = workoutCmd.Float64("target_valence", -1, "target valence (positivity), 0-1")
+	workoutTempo           = workoutCmd.Float64("target_tempo", -1, "target tempo in BPM")
+	showQueueCmd           = flag.NewFlagSet("show_queue", flag.ExitOnError)
+	splitCmd               = flag.NewFlagSet("split", flag.ExitOnError)
+	splitPlaylist          = splitCmd.String("playlist", "", "ID, URI, or URL of the playlist to split")
+	splitSize              = splitCmd.Int("size", 100, "number of tracks in each new playlist")
+	splitPrefix            = splitCmd.String("prefix", "Part", "name prefix of the new playlists, which are numbered from 1")
+	likeTopCmd             = flag.NewFlagSet("like_top", flag.ExitOnError)
+	likeTopTerm            = likeTopCmd.String("term", "medium", "term of top tracks to like: short, medium, or long")
+	archiveCmd             = flag.NewFlagSet("archive", flag.ExitOnError)
+	archiveTerm            = archiveCmd.String("term", "short", "term of top tracks to archive: short, medium, or long")
+	archiveTo              = archiveCmd.String("to", "", "name of the new archive playlist, e.g. \"Spring 2024\"")
+	customCmd              = flag.NewFlagSet("custom", flag.ExitOnError)
+	customTermRange        = customCmd.String("term-range", "medium", "term of top tracks to fill the playlist with: short, medium, or long")
+	customPlaylistName     = customCmd.String("playlist-name", "", "name of the playlist to fill, created if you don't have one by that name")
+	customLimit            = customCmd.Int("limit", maxTopTracks, "number of top tracks to fill the playlist with, fetched in pages past 50, up to 99")
+	customCount            = customCmd.Int("count", maxTopTracks, "same as --limit")
+	auditCmd               = flag.NewFlagSet("audit", flag.ExitOnError)
+	auditPlaylist          = auditCmd.String("playlist", "", "ID, URI, or URL of the playlist to audit")
+	auditRemove            = auditCmd.Bool("remove", false, "remove the unplayable tracks from the playlist")
+	recentAddsCmd          = flag.NewFlagSet("recent_adds", flag.ExitOnError)
+	recentAddsSince        = recentAddsCmd.Duration("since", 7*24*time2.Hour, "list tracks added within this long, e.g. 72h")
+	refreshCmd             = flag.NewFlagSet("refresh", flag.ExitOnError)
+	refreshThreshold       = refreshCmd.Float64("threshold", 0.5, "refill playlists whose staleness (0-1) is above this")
+	unfollowCmd            = flag.NewFlagSet("unfollow", flag.ExitOnError)
+	unfollowPattern        = unfollowCmd.String("pattern", "", "regular expression matched against playlist names")
+	unfollowYes            = unfollowCmd.Bool("yes", false, "don't ask for confirmation")
+	duplicatesCmd          = flag.NewFlagSet("duplicates", flag.ExitOnError)
+	duplicatesResolve      = duplicatesCmd.Bool("resolve", false, "for each group, ask which playlist to keep and unfollow the rest")
+	fillSearchCmd          = flag.NewFlagSet("fill_search", flag.ExitOnError)
+	fillSearchQuery        = fillSearchCmd.String("query", "", "Spotify search query, e.g. \"genre:jazz year:2020\"")
+	fillSearchPlaylist     = fillSearchCmd.String("playlist", "", "name of the playlist to fill, created if missing")
+	fillSearchCount        = fillSearchCmd.Int("count", 50, "number of matching tracks to add")
+	fillSearchMarket       = fillSearchCmd.String("market", "", "ISO 3166-1 alpha-2 country code to search in; defaults to your account's country")
+	fillSearchPopularity   = fillSearchCmd.Int("min_popularity", 0, "only add tracks with at least this popularity (0-100)")
+	fillSearchExplicit     = fillSearchCmd.String("explicit", "any", "filter on explicit lyrics: any, only, or exclude")
+	fillSearchMinDuration  = fillSearchCmd.Int("min_duration", 0, "skip tracks shorter than this many seconds")
+	fillSearchMaxDuration  = fillSearchCmd.Int("max_duration", 0, "skip tracks longer than this many seconds; 0 means no limit")
+	genresCmd              = flag.NewFlagSet("genres", flag.ExitOnError)
+	genresTerm             = genresCmd.String("term", "long", "term of top artists to tally: short, medium, or long")
+	genresTop              = genresCmd.Int("top", 10, "number of genres to print")
+	checkTokenCmd          = flag.NewFlagSet("check_token", flag.ExitOnError)
+	checkTokenFile         = checkTokenCmd.String("token_file", "", "path to a JSON-encoded OAuth token")
+	tokenScopesCmd         = flag.NewFlagSet("token_scopes", flag.ExitOnError)
+	tokenScopesFile        = tokenScopesCmd.String("token_file", "", "path to a JSON-encoded OAuth token")
+	exportM3UCmd           = flag.NewFlagSet("export_m3u", flag.ExitOnError)
+	exportM3UTerm          = exportM3UCmd.String("term", "medium", "term of top tracks to export: short, medium, or long")
+	exportM3UOut           = exportM3UCmd.String("out", "favorites.m3u", "path of the M3U file to write")
+	exportM3UURI           = exportM3UCmd.Bool("uri", false, "write spotify: URIs instead of open.spotify.com URLs")
+	topCmd                 = flag.NewFlagSet("top", flag.ExitOnError)
+	topTerm                = topCmd.String("term", "medium", "term to print top tracks for: short, medium, long, or all")
+	topParallel            = topCmd.Bool("parallel", false, "fetch terms concurrently when --term is all")
+	topConcurrency         = topCmd.Int("concurrency", 3, "maximum number of concurrent requests with --parallel")
+	compareCmd             = flag.NewFlagSet("compare", flag.ExitOnError)
+	comparePlaylist        = compareCmd.String("playlist", "", "ID, URI, or URL of the playlist to compare against")
+	compareTerm            = compareCmd.String("term", "medium", "term of top tracks to compare: short, medium, or long")
+	itemsCmd               = flag.NewFlagSet("items", flag.ExitOnError)
+	itemsPlaylist          = itemsCmd.String("playlist", "", "ID, URI, or URL of the playlist to list")
+	itemsMinPopularity     = itemsCmd.Int("min_popularity", 0, "only list tracks with at least this popularity (0-100)")
+	itemsByArtist          = itemsCmd.String("by_artist", "", "only list tracks by this artist (case-insensitive)")
+	itemsExplicit          = itemsCmd.String("explicit", "any", "filter on explicit lyrics: any, only, or exclude")
+	itemsFormat            = itemsCmd.String("format", "text", "output format: text or json")
 )
 
 type playlistConfig struct {
@@ -72,290 +344,3535 @@ type playlistConfig struct {
 	duration      spotify.Range
 	user          *spotify.PrivateUser
 	id            spotify.ID
+	snapshotID    string
+	maintainRank  bool
+	sortFinal     string
+	sortBy        string
+	dryRun        bool
+	sample        int
+	seed          int64
+	// source is sourceTracks or sourceArtists. Empty means sourceTracks.
+	source string
+	// limit is the number of top tracks to fetch, up to maxTopTracksTotal. Zero means
+	// maxTopTracks.
+	limit int
+	// retries caps the attempts per Spotify call, see newBackOff.
+	retries int
+	// filter drops top tracks before filling.
+	filter trackFilter
+	// newDescription, if set, replaces the playlist's description when it's filled.
+	newDescription string
+	// replace sets the playlist to exactly the top tracks instead of appending the new ones.
+	replace bool
+	// minEnergy and minDanceability drop top tracks whose audio features are lower.
+	// Zero means no minimum.
+	minEnergy       float64
+	minDanceability float64
+	// recommend is how many recommended tracks to add after the top tracks, seeded with
+	// the first of them and recommendGenres.
+	recommend       int
+	recommendGenres []string
+}
+
+// terms lists the supported terms in display order.
+var terms = []struct {
+	name     string
+	title    string
+	duration spotify.Range
+}{
+	{"short", "Short Term", spotify.ShortTermRange},
+	{"medium", "Medium Term", spotify.MediumTermRange},
+	{"long", "Long Term", spotify.LongTermRange},
+}
+
+// fillResult records the outcome of filling a single playlist.
+type fillResult struct {
+	added   int
+	skipped int
+	failed  int
+	// addedTracks holds "artist - title" for each track added, in order.
+	addedTracks []string
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// validateLimit checks the requested number of top tracks against what Spotify can
+// return for one term. With clamp set, a limit that's too large is capped with a
+// warning instead of being an error.
+func validateLimit(name string, limit int, clamp bool) (int, error) {
+	if limit < 1 {
+		return 0, fmt.Errorf("%v must be at least 1, got %d", name, limit)
+	}
+	if limit > maxTopTracksTotal {
+		if !clamp {
+			return 0, fmt.Errorf("%v %d is more than the %d top tracks Spotify returns per term; lower it or pass --clamp_limit", name, limit, maxTopTracksTotal)
+		}
+		slog.Warn("limit is more than the top tracks Spotify returns per term, capping it", "flag", name, "limit", limit, "using", maxTopTracksTotal)
+		return maxTopTracksTotal, nil
+	}
+	return limit, nil
 }
 
-func (config *playlistConfig) getTopTracks(ctx context.Context, c *spotify.Client) (*spotify.FullTrackPage, error) {
-	tracks, err := c.CurrentUsersTopTracks(ctx, spotify.Timerange(config.duration), spotify.Limit(50))
+func (config *playlistConfig) getTopTracks(ctx context.Context, c spotifyAPI) (*spotify.FullTrackPage, error) {
+	limit := config.limit
+	if limit == 0 {
+		limit = maxTopTracks
+	}
+	if config.source == sourceArtists {
+		// GetArtistsTopTracks needs a country: --market, else the user's from their profile.
+		country := config.filter.market
+		if country == "" && config.user != nil {
+			country = config.user.Country
+		}
+		if country == "" {
+			country = "US"
+		}
+		return topArtistTracks(ctx, c, config.duration, country, limit)
+	}
+	n := limit
+	if n > maxTopTracks {
+		n = maxTopTracks
+	}
+	tracks, err := c.CurrentUsersTopTracks(ctx, spotify.Timerange(config.duration), spotify.Limit(n))
 	if err != nil {
 		return nil, fmt.Errorf("unable to retrieve users top tracks: %v", err)
 	}
 	if tracks == nil {
-		fmt.Printf("tracks returned nil for some reason: %v", tracks)
+		slog.Warn("Spotify returned no top tracks", "term", config.duration)
 		return nil, nil
 	}
+	// A request returns at most maxTopTracks and offsets stop at 49, so the rest of a
+	// larger limit comes from the page ending at limit, minus the tracks it shares with
+	// the first one.
+	if limit > maxTopTracks && len(tracks.Tracks) == maxTopTracks && tracks.Next != "" {
+		offset := limit - maxTopTracks
+		page, err := c.CurrentUsersTopTracks(ctx, spotify.Timerange(config.duration), spotify.Limit(maxTopTracks), spotify.Offset(offset))
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve users top tracks: %v", err)
+		}
+		if overlap := maxTopTracks - offset; page != nil && len(page.Tracks) > overlap {
+			tracks.Tracks = append(tracks.Tracks, page.Tracks[overlap:]...)
+		}
+	}
 	return tracks, nil
 }
 
-func (config *playlistConfig) createPlaylist(ctx context.Context, c *spotify.Client, page *spotify.FullTrackPage) error {
-	newPlaylist, err := c.CreatePlaylistForUser(ctx, config.user.ID, config.name, config.description, config.public, config.collaborative)
+// tracksPerArtist is how many of each top artist's top tracks topArtistTracks takes.
+const tracksPerArtist = 3
+
+// topArtistTracks returns up to limit tracks made of the top tracks of the user's top
+// artists for term, in artist rank order.
+func topArtistTracks(ctx context.Context, c spotifyAPI, term spotify.Range, country string, limit int) (*spotify.FullTrackPage, error) {
+	artists, err := c.CurrentUsersTopArtists(ctx, spotify.Timerange(term), spotify.Limit(maxTopTracks))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("unable to retrieve users top artists: %v", err)
 	}
-	for _, v := range page.Tracks {
-		_, err := c.AddTracksToPlaylist(ctx, newPlaylist.ID, v.ID)
+	page := &spotify.FullTrackPage{}
+	for _, a := range artists.Artists {
+		tracks, err := c.GetArtistsTopTracks(ctx, a.ID, country)
 		if err != nil {
-			return fmt.Errorf("AddTracksToPlaylist(): unable to add track: %v\n", err)
+			return nil, fmt.Errorf("GetArtistsTopTracks(ctx,%v,%v): %v", a.ID, country, err)
+		}
+		if len(tracks) > tracksPerArtist {
+			tracks = tracks[:tracksPerArtist]
+		}
+		for _, t := range tracks {
+			if len(page.Tracks) == limit {
+				return page, nil
+			}
+			page.Tracks = append(page.Tracks, t)
 		}
 	}
-	return nil
+	return page, nil
 }
 
-func fillPlaylist(ctx context.Context, c *spotify.Client, playlistID spotify.ID, page *spotify.FullTrackPage) error {
-	for _, track := range page.Tracks {
-		op := func() error {
-			_, err := c.AddTracksToPlaylist(ctx, playlistID, track.ID)
+// printTopTracks prints the user's top tracks for the given term, or for every term
+// if term is "all". With parallel set the terms are fetched concurrently, but they're
+// always printed short, medium, long.
+func printTopTracks(ctx context.Context, c *spotify.Client, term string, parallel bool, concurrency int) error {
+	var configs []playlistConfig
+	var titles []string
+	for _, t := range terms {
+		if term == "all" || term == t.name {
+			configs = append(configs, playlistConfig{duration: t.duration})
+			titles = append(titles, t.title)
+		}
+	}
+	if len(configs) == 0 {
+		return fmt.Errorf("unknown term %q, want short, medium, long, or all", term)
+	}
+
+	pages := make([]*spotify.FullTrackPage, len(configs))
+	if parallel {
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(concurrency)
+		for i := range configs {
+			i := i
+			g.Go(func() error {
+				page, err := configs[i].getTopTracks(gctx, c)
+				pages[i] = page
+				return err
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return err
+		}
+	} else {
+		for i := range configs {
+			page, err := configs[i].getTopTracks(ctx, c)
 			if err != nil {
-				return fmt.Errorf("c.AddTracksToPlaylist(ctx,%v,%v): %v", playlistID, track.ID, err)
+				return err
 			}
-			return nil
+			pages[i] = page
 		}
+	}
 
-		err := backoff.Retry(op, backoff.NewExponentialBackOff())
-		if err != nil {
-			return fmt.Errorf("fillPlaylist(ctx,spotifyClient,%v,spotifyFullTrackPage): %v", playlistID, err)
+	for i, page := range pages {
+		fmt.Printf("%v:\n", titles[i])
+		if page == nil {
+			continue
+		}
+		for j, track := range page.Tracks {
+			fmt.Printf("%3d. %v\n", j+1, redact(trackName(track)))
 		}
 	}
 	return nil
 }
 
-func purgeTracks(ctx context.Context, c *spotify.Client, playlist spotify.SimplePlaylist) error {
-	plTracks, err := c.GetPlaylistItems(ctx, playlist.ID)
-	if err != nil {
+// writeM3U writes tracks as an extended M3U playlist. Each entry points at the track's
+// Spotify URL, or its URI if useURI is set.
+func writeM3U(w io.Writer, tracks []spotify.FullTrack, useURI bool) error {
+	if _, err := fmt.Fprintln(w, "#EXTM3U"); err != nil {
 		return err
 	}
-	var plTrackIDs []spotify.ID
-	for _, v := range plTracks.Items {
-		plTrackIDs = append(plTrackIDs, v.Track.Track.ID)
+	for _, t := range tracks {
+		location := t.ExternalURLs["spotify"]
+		if useURI || location == "" {
+			location = string(t.URI)
+		}
+		seconds := int(t.TimeDuration().Seconds())
+		if _, err := fmt.Fprintf(w, "#EXTINF:%d,%v\n%v\n", seconds, trackName(t), location); err != nil {
+			return err
+		}
 	}
-	_, err = c.RemoveTracksFromPlaylist(ctx, playlist.ID, plTrackIDs...)
 	return nil
 }
 
-func getCurrentPlaylists(ctx context.Context, c *spotify.Client) (*spotify.SimplePlaylistPage, error) {
-	pl, err := c.CurrentUsersPlaylists(ctx, spotify.Limit(50))
-	if err != nil {
-		return nil, err
+// termRange returns the spotify.Range for a term name.
+func termRange(name string) (spotify.Range, error) {
+	for _, t := range terms {
+		if t.name == name {
+			return t.duration, nil
+		}
 	}
-	return pl, nil
+	return "", fmt.Errorf("unknown term %q, want short, medium, or long", name)
 }
 
-// TODO(dduclayan): This should probably be renamed to something else, as it's getting and creating the playlists if
-// they are not found.
-func getAutomatedPlaylists(ctx context.Context, c *spotify.Client, user *spotify.PrivateUser, playlists *spotify.SimplePlaylistPage) ([]spotify.SimplePlaylist, error) {
-	var foundPlaylists []spotify.SimplePlaylist
-	for _, v := range playlists.Playlists {
-		if plMatch.MatchString(v.Name) {
-			foundPlaylists = append(foundPlaylists, v)
-		}
+// overlap returns the tracks present in both a and b, in a's order, along with their
+// Jaccard similarity (shared tracks over distinct tracks in either).
+func overlap(a, b []spotify.FullTrack) ([]spotify.FullTrack, float64) {
+	inB := make(map[spotify.ID]bool, len(b))
+	union := make(map[spotify.ID]bool, len(a)+len(b))
+	for _, t := range b {
+		inB[t.ID] = true
+		union[t.ID] = true
 	}
-	if len(foundPlaylists) == 0 {
-		playlistNames := []string{"Favorite Short Term Tracks", "Favorite Medium Term Tracks", "Favorite Long Term Tracks"}
-		description := "automated from top_tracks_cli"
-		for _, v := range playlistNames {
-			pl, err := c.CreatePlaylistForUser(ctx, user.ID, v, description, false, false)
-			if err != nil {
-				return nil, fmt.Errorf("CreatePlaylistForUser(ctx,%v,%v,%v,false,false): %v", user.ID, v, description, err)
-			}
-			foundPlaylists = append(foundPlaylists, pl.SimplePlaylist)
+	var shared []spotify.FullTrack
+	seen := make(map[spotify.ID]bool, len(a))
+	for _, t := range a {
+		if inB[t.ID] && !seen[t.ID] {
+			shared = append(shared, t)
 		}
+		seen[t.ID] = true
+		union[t.ID] = true
 	}
-	return foundPlaylists, nil
+	if len(union) == 0 {
+		return nil, 0
+	}
+	return shared, float64(len(shared)) / float64(len(union))
 }
 
-func getTopTracksAndFill(ctx context.Context, wg *sync.WaitGroup, c *spotify.Client, p playlistConfig) error {
-	defer wg.Done()
-	tt, err := p.getTopTracks(ctx, c)
+// compareWithPlaylist prints the tracks shared between the user's top tracks for the term
+// and the playlist, and how similar the two are. The playlist is only read, so it
+// doesn't need to be owned by the user.
+func compareWithPlaylist(ctx context.Context, c *spotify.Client, playlistID spotify.ID, term spotify.Range) error {
+	config := playlistConfig{duration: term}
+	top, err := config.getTopTracks(ctx, c)
+	if err != nil {
+		return err
+	}
+	items, err := getAllPlaylistItems(ctx, c, playlistID, playlistItemTypes(false))
 	if err != nil {
-		return fmt.Errorf("getTopTracks(): %v\n", err)
+		return err
+	}
+	var plTracks []spotify.FullTrack
+	for _, v := range items {
+		if itemKind(v) == "track" {
+			plTracks = append(plTracks, *v.Track.Track)
+		}
 	}
-	if err = fillPlaylist(ctx, c, p.id, tt); err != nil {
-		return fmt.Errorf("fillPlaylist(): %v\n", err)
+	var topTracks []spotify.FullTrack
+	if top != nil {
+		topTracks = top.Tracks
 	}
+	shared, score := overlap(topTracks, plTracks)
+	fmt.Printf("%d of your %d top tracks are on the playlist (%d tracks)\n", len(shared), len(topTracks), len(plTracks))
+	for _, t := range shared {
+		fmt.Printf("  %v\n", redact(trackName(t)))
+	}
+	fmt.Printf("Similarity: %.1f%%\n", score*100)
 	return nil
 }
 
-func completeAuth(w http.ResponseWriter, r *http.Request) {
-	tok, err := auth.Token(r.Context(), state, r)
-	if err != nil {
-		http.Error(w, "Couldn't get token", http.StatusForbidden)
-		log.Fatal(err)
+// audioTargets are the target audio features used to steer recommendations. A negative
+// value leaves that feature unset.
+type audioTargets struct {
+	energy       float64
+	danceability float64
+	valence      float64
+	tempo        float64
+}
+
+// validate checks that every set target is within the range Spotify accepts.
+func (t audioTargets) validate() error {
+	for _, f := range []struct {
+		name  string
+		value float64
+	}{
+		{"--target_energy", t.energy},
+		{"--target_danceability", t.danceability},
+		{"--target_valence", t.valence},
+	} {
+		if f.value > 1 {
+			return fmt.Errorf("%v must be between 0 and 1, got %v", f.name, f.value)
+		}
 	}
-	if st := r.FormValue("state"); st != state {
-		http.NotFound(w, r)
-		log.Fatalf("State mismatch: %s != %s\n", st, state)
+	if t.tempo > 300 {
+		return fmt.Errorf("--target_tempo must be between 0 and 300 BPM, got %v", t.tempo)
+	}
+	if t.energy < 0 && t.danceability < 0 && t.valence < 0 && t.tempo < 0 {
+		return fmt.Errorf("set at least one of --target_energy, --target_danceability, --target_valence, or --target_tempo")
+	}
+	return nil
+}
+
+// attributes returns the targets as recommendation track attributes.
+func (t audioTargets) attributes() *spotify.TrackAttributes {
+	attrs := spotify.NewTrackAttributes()
+	if t.energy >= 0 {
+		attrs = attrs.TargetEnergy(t.energy)
+	}
+	if t.danceability >= 0 {
+		attrs = attrs.TargetDanceability(t.danceability)
 	}
+	if t.valence >= 0 {
+		attrs = attrs.TargetValence(t.valence)
+	}
+	if t.tempo >= 0 {
+		attrs = attrs.TargetTempo(t.tempo)
+	}
+	return attrs
+}
+
+// genreCount is a genre's rank-weighted score among the user's top artists.
+type genreCount struct {
+	genre   string
+	score   int
+	artists int
+}
 
-	// use the token to get an authenticated client
-	client := spotify.New(auth.Client(r.Context(), tok))
-	_, err = fmt.Fprintf(w, "Login Completed!")
+// topGenres tallies the genres of the user's top artists for term. Each artist adds to
+// its genres a weight that falls with its rank, so the top artist counts the most.
+func topGenres(ctx context.Context, c *spotify.Client, term spotify.Range) ([]genreCount, error) {
+	artists, err := c.CurrentUsersTopArtists(ctx, spotify.Timerange(term), spotify.Limit(maxTopTracks))
 	if err != nil {
-		fmt.Printf("Fprintf(\"Login Completed\"): %v", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("CurrentUsersTopArtists(ctx,%v): %v", term, err)
+	}
+	byGenre := make(map[string]*genreCount)
+	var counts []*genreCount
+	for rank, a := range artists.Artists {
+		for _, g := range a.Genres {
+			gc, ok := byGenre[g]
+			if !ok {
+				gc = &genreCount{genre: g}
+				byGenre[g] = gc
+				counts = append(counts, gc)
+			}
+			gc.score += len(artists.Artists) - rank
+			gc.artists++
+		}
+	}
+	sort.SliceStable(counts, func(i, j int) bool { return counts[i].score > counts[j].score })
+	genres := make([]genreCount, 0, len(counts))
+	for _, gc := range counts {
+		genres = append(genres, *gc)
 	}
-	ch <- client
+	return genres, nil
 }
 
-func openBrowser(url string) {
-	var err error
+// previewItems is how many items previewArtists reads, so listings stay one call per
+// playlist however long it is.
+const previewItems = 50
 
-	switch runtime.GOOS {
-	case "linux":
-		err = exec.Command("xdg-open", url).Start()
-	case "windows":
-		err = exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
-	case "darwin":
-		err = exec.Command("open", url).Start()
-	default:
-		err = fmt.Errorf("unsupported platform")
+// previewArtistCount is how many artists --verbose lists per automated playlist.
+const previewArtistCount = 3
+
+// previewArtists returns up to n artists appearing most often among the first
+// previewItems tracks on the playlist, most frequent first.
+func previewArtists(ctx context.Context, c spotifyAPI, playlistID spotify.ID, n int) ([]string, error) {
+	page, err := c.GetPlaylistItems(ctx, playlistID, spotify.Limit(previewItems), playlistItemTypes(false))
+	if err != nil {
+		return nil, fmt.Errorf("GetPlaylistItems(ctx,%v): %v", redact(string(playlistID)), err)
+	}
+	counts := make(map[string]int)
+	var order []string
+	for _, v := range page.Items {
+		if v.Track.Track == nil {
+			continue
+		}
+		for _, a := range v.Track.Track.Artists {
+			if counts[a.Name] == 0 {
+				order = append(order, a.Name)
+			}
+			counts[a.Name]++
+		}
+	}
+	// The stable sort keeps ties in the order the artists first appear.
+	sort.SliceStable(order, func(i, j int) bool { return counts[order[i]] > counts[order[j]] })
+	if len(order) > n {
+		order = order[:n]
+	}
+	return order, nil
+}
+
+// findOrCreatePlaylist returns the ID of the user's own playlist called name, creating
+// it if there isn't one.
+func findOrCreatePlaylist(ctx context.Context, c *spotify.Client, user *spotify.PrivateUser, name string) (spotify.ID, error) {
+	playlists, err := allCurrentPlaylists(ctx, c)
+	if err != nil {
+		return "", fmt.Errorf("allCurrentPlaylists(ctx): %v", err)
+	}
+	for _, v := range playlists {
+		if v.Name == name && v.Owner.ID == user.ID {
+			return v.ID, nil
+		}
 	}
+	pl, err := c.CreatePlaylistForUser(ctx, user.ID, name, defaultDescription, false, false)
 	if err != nil {
-		log.Fatal(err)
+		return "", fmt.Errorf("CreatePlaylistForUser(ctx,%v,%v): %v", redact(user.ID), name, err)
 	}
+	return pl.ID, nil
 }
 
-func main() {
-	flag.Parse()
-	start := time2.Now()
-	ctx := context.Background()
-	http.HandleFunc("/callback", completeAuth)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Got request for:", r.URL.String())
-	})
-	go func() {
-		err := http.ListenAndServe(":8080", nil)
+// searchTracks returns up to count distinct tracks matching query and f, in search
+// order, following pagination until enough are found or the results run out.
+func searchTracks(ctx context.Context, c *spotify.Client, query string, count int, market string, f trackFilter) (*spotify.FullTrackPage, error) {
+	opts := []spotify.RequestOption{spotify.Limit(50)}
+	if market != "" {
+		opts = append(opts, spotify.Market(market))
+	}
+	res, err := c.Search(ctx, query, spotify.SearchTypeTrack, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Search(ctx,%q): %v", query, err)
+	}
+	found := &spotify.FullTrackPage{}
+	seen := make(map[spotify.ID]bool)
+	for res.Tracks != nil {
+		for _, t := range res.Tracks.Tracks {
+			if seen[t.ID] || !f.match(t) {
+				continue
+			}
+			seen[t.ID] = true
+			found.Tracks = append(found.Tracks, t)
+			if len(found.Tracks) == count {
+				return found, nil
+			}
+		}
+		err = c.NextTrackResults(ctx, res)
+		if err == spotify.ErrNoMorePages {
+			break
+		}
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("NextTrackResults(ctx,%q): %v", query, err)
 		}
-	}()
+	}
+	return found, nil
+}
 
-	url := auth.AuthURL(state)
-	openBrowser(url)
+// recommendForTargets returns up to limit recommended track IDs seeded with the user's
+// top tracks for term and steered towards targets.
+func recommendForTargets(ctx context.Context, c *spotify.Client, term spotify.Range, targets audioTargets, limit int) ([]spotify.ID, error) {
+	// Spotify accepts at most five seeds.
+	const maxSeeds = 5
+	config := playlistConfig{duration: term, limit: maxSeeds}
+	top, err := config.getTopTracks(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if top == nil || len(top.Tracks) == 0 {
+		return nil, fmt.Errorf("no top tracks to seed recommendations with")
+	}
+	var seeds spotify.Seeds
+	for _, t := range top.Tracks {
+		seeds.Tracks = append(seeds.Tracks, t.ID)
+	}
+	recs, err := c.GetRecommendations(ctx, seeds, targets.attributes(), spotify.Limit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("GetRecommendations(ctx,%v): %v", seeds.Tracks, err)
+	}
+	ids := make([]spotify.ID, 0, len(recs.Tracks))
+	for _, t := range recs.Tracks {
+		ids = append(ids, t.ID)
+	}
+	return ids, nil
+}
 
-	// wait for auth to complete
-	client := <-ch
+// recommendTracks returns up to n tracks recommended from the first tracks on top and
+// genres, five seeds in all. Tracks on top or in skip, e.g. those already on the
+// playlist, aren't recommended.
+func recommendTracks(ctx context.Context, c *spotify.Client, top *spotify.FullTrackPage, genres []string, n int, skip map[spotify.ID]bool) (*spotify.FullTrackPage, error) {
+	// Spotify accepts at most five seeds.
+	const maxSeeds = 5
+	seeds := spotify.Seeds{Genres: genres}
+	for _, t := range top.Tracks {
+		if len(seeds.Tracks)+len(seeds.Genres) == maxSeeds {
+			break
+		}
+		seeds.Tracks = append(seeds.Tracks, t.ID)
+	}
+	if len(seeds.Tracks) == 0 && len(seeds.Genres) == 0 {
+		return &spotify.FullTrackPage{}, nil
+	}
+	// Ask for extra tracks so some are left once the ones already present are dropped.
+	limit := 2 * n
+	if limit > 100 {
+		limit = 100
+	}
+	recs, err := c.GetRecommendations(ctx, seeds, nil, spotify.Limit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("GetRecommendations(ctx,%v,%v): %v", seeds.Tracks, seeds.Genres, err)
+	}
+	seen := make(map[spotify.ID]bool, len(top.Tracks))
+	for _, t := range top.Tracks {
+		seen[t.ID] = true
+	}
+	page := &spotify.FullTrackPage{}
+	for _, t := range recs.Tracks {
+		if len(page.Tracks) == n {
+			break
+		}
+		if seen[t.ID] || skip[t.ID] {
+			continue
+		}
+		seen[t.ID] = true
+		page.Tracks = append(page.Tracks, spotify.FullTrack{SimpleTrack: t})
+	}
+	return page, nil
+}
 
-	// use the client to make calls that require authorization
-	user, err := client.CurrentUser(context.Background())
+// createPlaylist creates config's playlist with the given tracks, in order.
+func (config *playlistConfig) createPlaylist(ctx context.Context, c *spotify.Client, tracks []spotify.FullTrack) (*spotify.FullPlaylist, error) {
+	newPlaylist, err := c.CreatePlaylistForUser(ctx, config.user.ID, config.name, config.description, config.public, config.collaborative)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	ids := make([]spotify.ID, 0, len(tracks))
+	for _, v := range tracks {
+		ids = append(ids, v.ID)
 	}
-	fmt.Println("You are logged in as:", user.ID)
+	if err := addTracks(ctx, c, newPlaylist.ID, ids); err != nil {
+		return newPlaylist, err
+	}
+	return newPlaylist, nil
+}
 
-	switch os.Args[1] {
-	case "playlist":
-		if err := playlistCmd.Parse(os.Args[2:]); err != nil {
-			fmt.Println("couldn't parse os.Args[2:]")
-			os.Exit(1)
+// newBackOff returns the backoff used to retry Spotify calls. A negative retries keeps
+// retrying until --retry-timeout passes; 0 disables retries. Retries stop once ctx is
+// done, e.g. when --timeout passes.
+func newBackOff(ctx context.Context, retries int) backoff.BackOff {
+	exp := backoff.NewExponentialBackOff()
+	// The library's default gives up only after 15 minutes, which looks like a hang.
+	exp.MaxElapsedTime = *retryTimeout
+	exp.Reset()
+	b := backoff.BackOff(exp)
+	if retries >= 0 {
+		b = backoff.WithMaxRetries(b, uint64(retries))
+	}
+	return backoff.WithContext(b, ctx)
+}
+
+// rateLimitBackOff waits out the Retry-After of a 429 instead of the usual backoff
+// interval, so a rate-limited call is never retried before Spotify allows. The wait is
+// jittered, see jitterRetryAfter.
+type rateLimitBackOff struct {
+	backoff.BackOff
+}
+
+func (b rateLimitBackOff) NextBackOff() time2.Duration {
+	d := b.BackOff.NextBackOff()
+	if d == backoff.Stop {
+		return d
+	}
+	if wait := pacer.wait(); wait > 0 {
+		return jitterRetryAfter(wait)
+	}
+	return d
+}
+
+// retrySpotify runs op, a Spotify call that changes a playlist, retrying it with
+// newBackOff and honoring Retry-After, so all writes handle rate limits the same way.
+func retrySpotify(ctx context.Context, retries int, op backoff.Operation) error {
+	return retryNotify(op, rateLimitBackOff{newBackOff(ctx, retries)})
+}
+
+// retryNotify runs op with b, logging each retry. If op never succeeds, the error it
+// last returned says how many attempts were made.
+func retryNotify(op backoff.Operation, b backoff.BackOff) error {
+	attempts := 0
+	counted := func() error {
+		attempts++
+		return op()
+	}
+	if err := backoff.RetryNotify(counted, b, logRetry); err != nil {
+		return fmt.Errorf("%v (gave up after %d attempts)", err, attempts)
+	}
+	return nil
+}
+
+// fillPlaylist adds the tracks on page to the playlist, skipping any whose ID is in skip
+// and any repeated on page.
+func fillPlaylist(ctx context.Context, c spotifyAPI, playlistID spotify.ID, name string, page *spotify.FullTrackPage, skip map[spotify.ID]bool, retries int, dryRun bool) (fillResult, error) {
+	var res fillResult
+	var tracks []spotify.FullTrack
+	seen := make(map[spotify.ID]bool, len(page.Tracks))
+	for _, track := range page.Tracks {
+		if skip[track.ID] || seen[track.ID] {
+			res.skipped++
+			continue
 		}
-		if *playlistList == true {
-			fmt.Printf("Printing all current playlists for user: %v\n", user.ID)
-			allUsersPlaylists, err := getCurrentPlaylists(ctx, client)
-			if err != nil {
-				fmt.Printf("unable to get user playlists: %v\n", err)
-				os.Exit(1)
-			}
-			for _, v := range allUsersPlaylists.Playlists {
-				fmt.Printf("name: %v\tid: %v\n", v.Name, v.ID)
-			}
+		seen[track.ID] = true
+		tracks = append(tracks, track)
+	}
+	// With dryRun the result says what would be added, with each track's ID.
+	if dryRun {
+		for _, t := range tracks {
+			res.added++
+			res.addedTracks = append(res.addedTracks, fmt.Sprintf("%v (%v)", trackName(t), t.ID))
 		}
-		if *playlistPurgeFavTracks == true {
-			fmt.Println("Purging tracks from the automated playlists")
-			allUsersPlaylists, err := getCurrentPlaylists(ctx, client)
-			if err != nil {
-				fmt.Printf("unable to get user playlists: %v\n", err)
-				os.Exit(1)
-			}
-			automatedPlaylists, err := getAutomatedPlaylists(ctx, client, user, allUsersPlaylists)
-			if err != nil {
-				fmt.Printf("getAutomatedPlaylists(ctx,client,%v,%v): %v", user, allUsersPlaylists, err)
-				os.Exit(1)
-			}
-			for _, v := range automatedPlaylists {
-				fmt.Printf("purging tracks on playlist %v\n", v.Name)
-				err = purgeTracks(ctx, client, v)
-				if err != nil {
-					fmt.Printf("purgeTracks() failed: %v\n", err)
-				}
-			}
+		return res, nil
+	}
+
+	// AddTracksToPlaylist accepts at most 100 tracks per call.
+	const batchSize = 100
+	for i := 0; i < len(tracks); i += batchSize {
+		end := i + batchSize
+		if end > len(tracks) {
+			end = len(tracks)
 		}
-		// TODO(dduclayan): Deal with duplicates
-		// TODO(dduclayan): Refactor to google style guide
-		if *playlistFill == true {
-			allUsersPlaylists, err := getCurrentPlaylists(ctx, client)
-			if err != nil {
-				fmt.Printf("unable to get user playlists: %v", err)
-				os.Exit(1)
-			}
-			automatedPlaylists, err := getAutomatedPlaylists(ctx, client, user, allUsersPlaylists)
+		batch := tracks[i:end]
+		ids := make([]spotify.ID, 0, len(batch))
+		for _, t := range batch {
+			ids = append(ids, t.ID)
+		}
+		op := func() error {
+			_, err := c.AddTracksToPlaylist(ctx, playlistID, ids...)
 			if err != nil {
-				fmt.Printf("getAutomatedPlaylists(ctx,client,%v,%v): %v", user, allUsersPlaylists, err)
-				os.Exit(1)
-			}
-			var shortTermConfig playlistConfig
-			var medTermConfig playlistConfig
-			var longTermConfig playlistConfig
-			for _, v := range automatedPlaylists {
-				if shortTermRe.MatchString(v.Name) {
-					shortTermConfig = playlistConfig{
-						name:          v.Name,
-						public:        v.IsPublic,
-						description:   v.Description,
-						collaborative: v.Collaborative,
-						duration:      spotify.ShortTermRange,
-						user:          user,
-						id:            v.ID,
-					}
-				}
-				if medTermRe.MatchString(v.Name) {
-					medTermConfig = playlistConfig{
-						name:          v.Name,
-						public:        v.IsPublic,
-						description:   v.Description,
-						collaborative: v.Collaborative,
-						duration:      spotify.MediumTermRange,
-						user:          user,
-						id:            v.ID,
-					}
-				}
-				if longTermRe.MatchString(v.Name) {
-					longTermConfig = playlistConfig{
-						name:          v.Name,
-						public:        v.IsPublic,
-						description:   v.Description,
-						collaborative: v.Collaborative,
-						duration:      spotify.LongTermRange,
-						user:          user,
-						id:            v.ID,
-					}
-				}
+				return fmt.Errorf("c.AddTracksToPlaylist(ctx,%v,%d tracks): %v", redact(string(playlistID)), len(ids), err)
 			}
+			return nil
+		}
 
-			// TODO: Should errGroup here.
-			var wg sync.WaitGroup
-			wg.Add(3)
-			go func() {
-				err := getTopTracksAndFill(ctx, &wg, client, shortTermConfig)
-				if err != nil {
-					fmt.Printf("getTopTracksAndFill() failed: %v", err)
-					os.Exit(1)
-				}
-			}()
-			go func() {
-				err := getTopTracksAndFill(ctx, &wg, client, medTermConfig)
-				if err != nil {
-					fmt.Printf("getTopTracksAndFill() failed: %v", err)
-					os.Exit(1)
-				}
-			}()
-			go func() {
-				err := getTopTracksAndFill(ctx, &wg, client, longTermConfig)
-				if err != nil {
-					fmt.Printf("getTopTracksAndFill() failed: %v", err)
-					os.Exit(1)
-				}
-			}()
-			wg.Wait()
+		// Stop retrying once ctx is cancelled, e.g. because another fill failed.
+		err := retrySpotify(ctx, retries, op)
+		if err != nil {
+			res.failed = len(tracks) - i
+			return res, fmt.Errorf("fillPlaylist(ctx,spotifyClient,%v,spotifyFullTrackPage): batch %d (tracks %d-%d): %v", redact(string(playlistID)), i/batchSize, i+1, end, err)
 		}
+		res.added += len(batch)
+		for _, t := range batch {
+			res.addedTracks = append(res.addedTracks, trackName(t))
+		}
+		logProgress(ctx, "added tracks", "playlist", name, "added", res.added, "of", len(tracks))
+	}
+	return res, nil
+}
+
+// trackFilter selects tracks by popularity, artist, and explicitness. The zero value
+// matches every track.
+type trackFilter struct {
+	minPopularity int
+	// artist matches any of the track's artists, ignoring case.
+	artist string
+	// explicit is "any", "only", or "exclude". Empty is treated as "any".
+	explicit string
+	// minDuration and maxDuration bound the track length. Zero means no bound.
+	minDuration time2.Duration
+	maxDuration time2.Duration
+	// exclude lists artist names, matched ignoring case, and excludeIDs track IDs, as
+	// split by parseExclude.
+	exclude    []string
+	excludeIDs []spotify.ID
+	// market, if set, is an ISO 3166-1 alpha-2 country code the track must be available in.
+	market string
+}
+
+func (f trackFilter) validate() error {
+	if f.minPopularity < 0 || f.minPopularity > 100 {
+		return fmt.Errorf("minimum popularity %d is outside 0-100", f.minPopularity)
+	}
+	switch f.explicit {
+	case "", "any", "only", "exclude":
+	default:
+		return fmt.Errorf("unknown explicit filter %q, want any, only, or exclude", f.explicit)
+	}
+	if f.minDuration < 0 || f.maxDuration < 0 {
+		return fmt.Errorf("durations can't be negative")
+	}
+	if f.maxDuration > 0 && f.minDuration > f.maxDuration {
+		return fmt.Errorf("minimum duration %v is longer than maximum duration %v", f.minDuration, f.maxDuration)
+	}
+	if f.market != "" && len(f.market) != 2 {
+		return fmt.Errorf("market %q isn't a two-letter ISO 3166-1 country code", f.market)
+	}
+	return nil
+}
+
+// filterTracks returns a copy of page holding only the tracks matching f, along with
+// the number of tracks left out.
+func filterTracks(page *spotify.FullTrackPage, f trackFilter) (*spotify.FullTrackPage, int) {
+	if page == nil {
+		return nil, 0
+	}
+	filtered := *page
+	filtered.Tracks = nil
+	for _, t := range page.Tracks {
+		if entry, ok := f.excludedBy(t); ok {
+			slog.Info("excluded track", "track", redact(trackName(t)), "id", redact(string(t.ID)), "matched", entry)
+			continue
+		}
+		if f.match(t) {
+			filtered.Tracks = append(filtered.Tracks, t)
+		}
+	}
+	return &filtered, len(page.Tracks) - len(filtered.Tracks)
+}
+
+func (f trackFilter) match(track spotify.FullTrack) bool {
+	if _, ok := f.excludedBy(track); ok {
+		return false
+	}
+	if int(track.Popularity) < f.minPopularity {
+		return false
+	}
+	if f.explicit == "only" && !track.Explicit || f.explicit == "exclude" && track.Explicit {
+		return false
+	}
+	if d := track.TimeDuration(); d < f.minDuration || f.maxDuration > 0 && d > f.maxDuration {
+		return false
+	}
+	if f.market != "" && !availableIn(track, f.market) {
+		return false
+	}
+	if f.artist != "" {
+		for _, a := range track.Artists {
+			if strings.EqualFold(a.Name, f.artist) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// availableIn reports whether track can be played in market. Tracks fetched with a market
+// say so directly; otherwise their available markets are checked.
+func availableIn(track spotify.FullTrack, market string) bool {
+	if track.IsPlayable != nil {
+		return *track.IsPlayable
+	}
+	for _, m := range track.AvailableMarkets {
+		if strings.EqualFold(m, market) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedBy returns the entry of f.exclude or f.excludeIDs that matches track, if any.
+func (f trackFilter) excludedBy(track spotify.FullTrack) (string, bool) {
+	for _, id := range f.excludeIDs {
+		if id == track.ID {
+			return string(id), true
+		}
+	}
+	for _, e := range f.exclude {
+		for _, a := range track.Artists {
+			if strings.EqualFold(a.Name, e) {
+				return e, true
+			}
+		}
+	}
+	return "", false
+}
+
+// parseExclude splits an --exclude value into artist names and track IDs. Entries that
+// look like a bare ID, URI, or URL go through parseID, so a pasted link to anything but
+// a track is an error rather than a name that never matches.
+func parseExclude(s string) ([]string, []spotify.ID, error) {
+	var names []string
+	var ids []spotify.ID
+	for _, e := range splitList(s) {
+		if !spotifyID.MatchString(e) && !strings.HasPrefix(e, "spotify:") && !strings.Contains(e, "open.spotify.com/") {
+			names = append(names, e)
+			continue
+		}
+		id, err := parseID("track", e)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--exclude: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return names, ids, nil
+}
+
+// splitList splits a comma-separated flag value, trimming spaces and dropping empty
+// entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// printPlaylistItems prints the tracks on the playlist that match filter, as text or
+// as a JSON array.
+func printPlaylistItems(ctx context.Context, c *spotify.Client, playlistID spotify.ID, filter trackFilter, format string) error {
+	items, err := getAllPlaylistItems(ctx, c, playlistID, playlistItemTypes(false))
+	if err != nil {
+		return err
+	}
+	type jsonTrack struct {
+		ID         spotify.ID `json:"id"`
+		Name       string     `json:"name"`
+		Artists    []string   `json:"artists"`
+		Popularity int        `json:"popularity"`
+		Explicit   bool       `json:"explicit"`
+	}
+	matched := []jsonTrack{}
+	for _, v := range items {
+		if itemKind(v) != "track" || !filter.match(*v.Track.Track) {
+			continue
+		}
+		t := v.Track.Track
+		var artists []string
+		for _, a := range t.Artists {
+			artists = append(artists, a.Name)
+		}
+		matched = append(matched, jsonTrack{t.ID, t.Name, artists, int(t.Popularity), t.Explicit})
+		if format == "text" {
+			fmt.Printf("%v\tpopularity: %v\tid: %v\n", redact(trackName(*t)), t.Popularity, redact(string(t.ID)))
+		}
+	}
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(matched)
+	}
+	return nil
+}
+
+// trackName formats a track as "artist, artist - title".
+func trackName(track spotify.FullTrack) string {
+	var artists []string
+	for _, a := range track.Artists {
+		artists = append(artists, a.Name)
+	}
+	return fmt.Sprintf("%v - %v", strings.Join(artists, ", "), track.Name)
+}
+
+// existingTrackIDs returns the set of track IDs already on the playlist.
+func existingTrackIDs(ctx context.Context, c spotifyAPI, playlistID spotify.ID) (map[spotify.ID]bool, error) {
+	items, err := getAllPlaylistItems(ctx, c, playlistID, playlistItemTypes(false))
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[spotify.ID]bool, len(items))
+	for _, v := range items {
+		if itemKind(v) == "track" {
+			ids[v.Track.Track.ID] = true
+		}
+	}
+	return ids, nil
+}
+
+// playlistItemTypes returns the option selecting which item types GetPlaylistItems
+// returns. Episodes are only requested when asked for, so callers that only know how
+// to handle tracks don't see them.
+func playlistItemTypes(episodes bool) spotify.RequestOption {
+	if episodes {
+		return spotify.AdditionalTypes(spotify.TrackAdditionalType, spotify.EpisodeAdditionalType)
+	}
+	return spotify.AdditionalTypes(spotify.TrackAdditionalType)
+}
+
+// itemKind returns what a playlist item holds: "track", "local" for a local file,
+// "episode", or "" if Spotify returned no content, e.g. for an item unavailable in the
+// market. Unless episodes are requested, Spotify returns them as tracks with an
+// episode URI, so those are told apart by URI too.
+func itemKind(v spotify.PlaylistItem) string {
+	switch {
+	case v.Track.Episode != nil:
+		return "episode"
+	case v.Track.Track == nil:
+		return ""
+	case strings.HasPrefix(string(v.Track.Track.URI), "spotify:episode:"):
+		return "episode"
+	case v.IsLocal || v.Track.Track.ID == "":
+		return "local"
+	}
+	return "track"
+}
+
+// itemURI returns the URI of a playlist item's content, or "" if it has none.
+func itemURI(v spotify.PlaylistItem) spotify.URI {
+	switch {
+	case v.Track.Episode != nil:
+		return v.Track.Episode.URI
+	case v.Track.Track != nil:
+		return v.Track.Track.URI
+	}
+	return ""
+}
+
+// getAllPlaylistItems returns every item in the playlist, following pagination.
+func getAllPlaylistItems(ctx context.Context, c spotifyAPI, playlistID spotify.ID, opts ...spotify.RequestOption) ([]spotify.PlaylistItem, error) {
+	var items []spotify.PlaylistItem
+	for {
+		page, err := c.GetPlaylistItems(ctx, playlistID, append(opts, spotify.Offset(len(items)))...)
+		if err != nil {
+			return nil, fmt.Errorf("GetPlaylistItems(ctx,%v): %v", redact(string(playlistID)), err)
+		}
+		items = append(items, page.Items...)
+		if page.Next == "" || len(page.Items) == 0 {
+			return items, nil
+		}
+	}
+}
+
+// rankPlaylist rewrites the playlist so the tracks in page come first in ranking order,
+// followed by the remaining tracks in their current order. Each ranked track is kept
+// only once. Episodes and local files can't be passed to ReplacePlaylistTracks, so a
+// playlist holding any is reordered in place by moveItems instead: its ranked tracks
+// are moved to the front and everything else, repeats included, keeps its order.
+func rankPlaylist(ctx context.Context, c *spotify.Client, playlistID spotify.ID, page *spotify.FullTrackPage) error {
+	items, err := getAllPlaylistItems(ctx, c, playlistID, playlistItemTypes(false))
+	if err != nil {
+		return err
+	}
+	first := make(map[spotify.ID]int)
+	for i, v := range items {
+		if itemKind(v) != "track" {
+			continue
+		}
+		if _, ok := first[v.Track.Track.ID]; !ok {
+			first[v.Track.Track.ID] = i
+		}
+	}
+	ranked := make(map[int]bool)
+	var order []int
+	for _, track := range page.Tracks {
+		if i, ok := first[track.ID]; ok && !ranked[i] {
+			ranked[i] = true
+			order = append(order, i)
+		}
+	}
+	if !onlyTracks(items) {
+		for i := range items {
+			if !ranked[i] {
+				order = append(order, i)
+			}
+		}
+		return moveItems(ctx, c, playlistID, order)
+	}
+	ids := make([]spotify.ID, 0, len(items))
+	for _, i := range order {
+		ids = append(ids, items[i].Track.Track.ID)
+	}
+	for _, v := range items {
+		if id := v.Track.Track.ID; !ranked[first[id]] {
+			ids = append(ids, id)
+		}
+	}
+	return replacePlaylistTracks(ctx, c, playlistID, ids)
+}
+
+// audioFeatures returns the audio features of the tracks, by ID. Tracks Spotify has no
+// features for are left out.
+func audioFeatures(ctx context.Context, c *spotify.Client, ids []spotify.ID) (map[spotify.ID]*spotify.AudioFeatures, error) {
+	features := make(map[spotify.ID]*spotify.AudioFeatures, len(ids))
+	// GetAudioFeatures takes at most 100 IDs.
+	for i := 0; i < len(ids); i += 100 {
+		end := i + 100
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch, err := c.GetAudioFeatures(ctx, ids[i:end]...)
+		if err != nil {
+			return nil, fmt.Errorf("GetAudioFeatures(ctx): %v", err)
+		}
+		for _, f := range batch {
+			if f != nil {
+				features[f.ID] = f
+			}
+		}
+	}
+	return features, nil
+}
+
+// filterByFeatures drops the tracks on page whose energy or danceability is below the
+// given minimum; a zero minimum isn't checked. Tracks without audio features are kept.
+// It logs how many tracks each minimum dropped; a track below both counts for both.
+func filterByFeatures(ctx context.Context, c *spotify.Client, page *spotify.FullTrackPage, name string, minEnergy, minDanceability float64) (*spotify.FullTrackPage, error) {
+	if minEnergy == 0 && minDanceability == 0 {
+		return page, nil
+	}
+	ids := make([]spotify.ID, 0, len(page.Tracks))
+	for _, t := range page.Tracks {
+		ids = append(ids, t.ID)
+	}
+	features, err := audioFeatures(ctx, c, ids)
+	if err != nil {
+		return nil, err
+	}
+	filtered := *page
+	filtered.Tracks = nil
+	lowEnergy, lowDance := 0, 0
+	for _, t := range page.Tracks {
+		f, ok := features[t.ID]
+		if !ok {
+			filtered.Tracks = append(filtered.Tracks, t)
+			continue
+		}
+		keep := true
+		if float64(f.Energy) < minEnergy {
+			lowEnergy++
+			keep = false
+		}
+		if float64(f.Danceability) < minDanceability {
+			lowDance++
+			keep = false
+		}
+		if keep {
+			filtered.Tracks = append(filtered.Tracks, t)
+		}
+	}
+	if minEnergy > 0 {
+		slog.Info("filtered tracks by energy", "playlist", name, "min", minEnergy, "dropped", lowEnergy)
+	}
+	if minDanceability > 0 {
+		slog.Info("filtered tracks by danceability", "playlist", name, "min", minDanceability, "dropped", lowDance)
+	}
+	return &filtered, nil
+}
+
+// validSortKeys are the orders sortPlaylist accepts.
+var validSortKeys = map[string]bool{"popularity": true, "release_date": true, "duration": true, "tempo": true}
+
+// sortPlaylist reorders the playlist's tracks: most popular first, newest release
+// first, shortest first, or slowest first, depending on by. Ties keep their order.
+// Episodes and local files can't be passed to ReplacePlaylistTracks, so as in
+// rankPlaylist a playlist holding any is reordered in place, with those items after
+// the sorted tracks.
+func sortPlaylist(ctx context.Context, c *spotify.Client, playlistID spotify.ID, by string) error {
+	items, err := getAllPlaylistItems(ctx, c, playlistID, playlistItemTypes(false))
+	if err != nil {
+		return err
+	}
+	var tracks []*spotify.FullTrack
+	// positions holds the position of each track on the playlist, and rest those of
+	// the other items.
+	positions := make(map[*spotify.FullTrack]int)
+	var rest []int
+	for i, v := range items {
+		if itemKind(v) == "track" {
+			tracks = append(tracks, v.Track.Track)
+			positions[v.Track.Track] = i
+		} else {
+			rest = append(rest, i)
+		}
+	}
+
+	var less func(a, b *spotify.FullTrack) bool
+	switch by {
+	case "popularity":
+		less = func(a, b *spotify.FullTrack) bool { return a.Popularity > b.Popularity }
+	case "release_date":
+		less = func(a, b *spotify.FullTrack) bool { return a.Album.ReleaseDateTime().After(b.Album.ReleaseDateTime()) }
+	case "duration":
+		less = func(a, b *spotify.FullTrack) bool { return a.Duration < b.Duration }
+	case "tempo":
+		ids := make([]spotify.ID, 0, len(tracks))
+		for _, t := range tracks {
+			ids = append(ids, t.ID)
+		}
+		features, err := audioFeatures(ctx, c, ids)
+		if err != nil {
+			return err
+		}
+		tempo := func(id spotify.ID) float32 {
+			if f, ok := features[id]; ok {
+				return f.Tempo
+			}
+			return 0
+		}
+		less = func(a, b *spotify.FullTrack) bool { return tempo(a.ID) < tempo(b.ID) }
+	default:
+		return fmt.Errorf("unknown sort order %q", by)
+	}
+	sort.SliceStable(tracks, func(i, j int) bool { return less(tracks[i], tracks[j]) })
+
+	if len(rest) > 0 {
+		order := make([]int, 0, len(items))
+		for _, t := range tracks {
+			order = append(order, positions[t])
+		}
+		return moveItems(ctx, c, playlistID, append(order, rest...))
+	}
+	ids := make([]spotify.ID, 0, len(tracks))
+	for _, t := range tracks {
+		ids = append(ids, t.ID)
+	}
+	return replacePlaylistTracks(ctx, c, playlistID, ids)
+}
+
+// sortOrders are the orders sortTracks accepts.
+var sortOrders = map[string]bool{"rank": true, "popularity": true, "release": true, "name": true}
+
+// sortTracks returns page with its tracks in the given order: "rank", the default,
+// keeps Spotify's ranking; "popularity" puts the most popular first; "release" the
+// newest album first; and "name" sorts by track name, ignoring case. Ties keep their
+// ranked order.
+func sortTracks(page *spotify.FullTrackPage, by string) *spotify.FullTrackPage {
+	var less func(a, b *spotify.FullTrack) bool
+	switch by {
+	case "popularity":
+		less = func(a, b *spotify.FullTrack) bool { return a.Popularity > b.Popularity }
+	case "release":
+		less = func(a, b *spotify.FullTrack) bool { return a.Album.ReleaseDateTime().After(b.Album.ReleaseDateTime()) }
+	case "name":
+		less = func(a, b *spotify.FullTrack) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) }
+	default:
+		return page
+	}
+	sorted := *page
+	sorted.Tracks = append([]spotify.FullTrack(nil), page.Tracks...)
+	sort.SliceStable(sorted.Tracks, func(i, j int) bool { return less(&sorted.Tracks[i], &sorted.Tracks[j]) })
+	return &sorted
+}
+
+// replacePlaylistTracks sets the playlist's contents to ids, in order.
+func replacePlaylistTracks(ctx context.Context, c *spotify.Client, playlistID spotify.ID, ids []spotify.ID) error {
+	// ReplacePlaylistTracks accepts at most 100 tracks; the rest are appended.
+	const batchSize = 100
+	first := ids
+	if len(first) > batchSize {
+		first = first[:batchSize]
+	}
+	if err := c.ReplacePlaylistTracks(ctx, playlistID, first...); err != nil {
+		return fmt.Errorf("ReplacePlaylistTracks(ctx,%v): %v", redact(string(playlistID)), err)
+	}
+	return addTracks(ctx, c, playlistID, ids[len(first):])
+}
+
+// onlyTracks reports whether every item is a Spotify track, so the playlist can be
+// rewritten with replacePlaylistTracks without losing anything.
+func onlyTracks(items []spotify.PlaylistItem) bool {
+	for _, v := range items {
+		if itemKind(v) != "track" {
+			return false
+		}
+	}
+	return true
+}
+
+// moveItems reorders the playlist in place, one ReorderPlaylistTracks call per item out
+// of place, so that the item now at position order[i] ends up at i. order must hold
+// every position once. Nothing is removed and re-added, so episodes and local files
+// are kept.
+func moveItems(ctx context.Context, c *spotify.Client, playlistID spotify.ID, order []int) error {
+	// current[i] is the original position of the item now at i.
+	current := make([]int, len(order))
+	for i := range current {
+		current[i] = i
+	}
+	for i, want := range order {
+		j := i
+		for current[j] != want {
+			j++
+		}
+		if j == i {
+			continue
+		}
+		opt := spotify.PlaylistReorderOptions{RangeStart: spotify.Numeric(j), InsertBefore: spotify.Numeric(i)}
+		if _, err := c.ReorderPlaylistTracks(ctx, playlistID, opt); err != nil {
+			return fmt.Errorf("ReorderPlaylistTracks(ctx,%v,%d,%d): %v", redact(string(playlistID)), j, i, err)
+		}
+		copy(current[i+1:j+1], current[i:j])
+		current[i] = want
+	}
+	return nil
+}
+
+// addTracks appends ids to the playlist in batches of 100, the most Spotify accepts per call.
+// The batches are sent one at a time on purpose: AddTracksToPlaylist can't say where to
+// insert, so concurrent batches would land in whatever order they complete.
+func addTracks(ctx context.Context, c *spotify.Client, playlistID spotify.ID, ids []spotify.ID) error {
+	const batchSize = 100
+	for i := 0; i < len(ids); i += batchSize {
+		end := i + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if _, err := c.AddTracksToPlaylist(ctx, playlistID, ids[i:end]...); err != nil {
+			return fmt.Errorf("AddTracksToPlaylist(ctx,%v): %v", redact(string(playlistID)), err)
+		}
+	}
+	return nil
+}
+
+// lastAddedAt returns the time the most recent item was added to the playlist. The
+// zero time is returned if the playlist is empty or has no timestamps.
+func lastAddedAt(ctx context.Context, c *spotify.Client, playlistID spotify.ID) (time2.Time, error) {
+	items, err := getAllPlaylistItems(ctx, c, playlistID, playlistItemTypes(true))
+	if err != nil {
+		return time2.Time{}, err
+	}
+	var latest time2.Time
+	for _, v := range items {
+		if v.AddedAt == "" {
+			continue
+		}
+		added, err := time2.Parse(spotify.TimestampLayout, v.AddedAt)
+		if err != nil {
+			return time2.Time{}, fmt.Errorf("time.Parse(%v): %v", v.AddedAt, err)
+		}
+		if added.After(latest) {
+			latest = added
+		}
+	}
+	return latest, nil
+}
+
+// recentAdd is a track added to one of the user's playlists.
+type recentAdd struct {
+	addedAt  time2.Time
+	track    string
+	playlist string
+}
+
+// recentAdds returns the tracks added to playlists owned by user since the given time,
+// newest first.
+func recentAdds(ctx context.Context, c *spotify.Client, user *spotify.PrivateUser, since time2.Time) ([]recentAdd, error) {
+	playlists, err := allCurrentPlaylists(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("allCurrentPlaylists(ctx): %v", err)
+	}
+	var adds []recentAdd
+	for _, pl := range playlists {
+		if pl.Owner.ID != user.ID {
+			continue
+		}
+		items, err := getAllPlaylistItems(ctx, c, pl.ID, playlistItemTypes(false))
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range items {
+			if v.Track.Track == nil {
+				continue
+			}
+			added, err := time2.Parse(spotify.TimestampLayout, v.AddedAt)
+			if err != nil {
+				// Very old playlists have no added_at; there's no telling when those were added.
+				slog.Debug("skipping item without an added date", "playlist", pl.Name, "added_at", v.AddedAt)
+				continue
+			}
+			if added.Before(since) {
+				continue
+			}
+			adds = append(adds, recentAdd{addedAt: added, track: trackName(*v.Track.Track), playlist: pl.Name})
+		}
+	}
+	sort.SliceStable(adds, func(i, j int) bool { return adds[i].addedAt.After(adds[j].addedAt) })
+	return adds, nil
+}
+
+// deadTrack is a playlist entry that can't be played.
+type deadTrack struct {
+	position int
+	uri      spotify.URI
+	name     string
+	reason   string
+}
+
+// unplayableTracks returns the playlist's tracks that can't be played in market. An
+// empty market falls back to checking that the track is available anywhere.
+func unplayableTracks(ctx context.Context, c *spotify.Client, playlistID spotify.ID, market string) ([]deadTrack, error) {
+	opts := []spotify.RequestOption{playlistItemTypes(false)}
+	if market != "" {
+		// With a market, Spotify fills in IsPlayable and relinks tracks where it can.
+		opts = append(opts, spotify.Market(market))
+	}
+	items, err := getAllPlaylistItems(ctx, c, playlistID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var dead []deadTrack
+	for i, v := range items {
+		t := v.Track.Track
+		switch {
+		case t == nil:
+			dead = append(dead, deadTrack{position: i, name: "(unknown)", reason: "removed from Spotify"})
+		case t.IsPlayable != nil && !*t.IsPlayable:
+			dead = append(dead, deadTrack{position: i, uri: t.URI, name: trackName(*t), reason: "not playable in " + market})
+		case market == "" && len(t.AvailableMarkets) == 0:
+			dead = append(dead, deadTrack{position: i, uri: t.URI, name: trackName(*t), reason: "not available in any market"})
+		}
+	}
+	return dead, nil
+}
+
+// removeDeadTracks removes dead from the playlist by position. Entries without a URI
+// can't be addressed by the API and are left in place.
+func removeDeadTracks(ctx context.Context, c *spotify.Client, playlistID spotify.ID, dead []deadTrack) (int, error) {
+	var remove []spotify.TrackToRemove
+	for _, d := range dead {
+		if d.uri == "" {
+			continue
+		}
+		remove = append(remove, spotify.TrackToRemove{URI: string(d.uri), Positions: []int{d.position}})
+	}
+	// Remove from the end in batches of 100 so earlier positions stay valid.
+	sort.Slice(remove, func(i, j int) bool { return remove[i].Positions[0] > remove[j].Positions[0] })
+	const batchSize = 100
+	for i := 0; i < len(remove); i += batchSize {
+		end := i + batchSize
+		if end > len(remove) {
+			end = len(remove)
+		}
+		if _, err := c.RemoveTracksFromPlaylistOpt(ctx, playlistID, remove[i:end], ""); err != nil {
+			return i, fmt.Errorf("RemoveTracksFromPlaylistOpt(ctx,%v): %v", redact(string(playlistID)), err)
+		}
+	}
+	return len(remove), nil
+}
+
+// likeTracks saves the tracks to the user's Liked Songs, skipping ones already there,
+// and returns how many were newly liked.
+func likeTracks(ctx context.Context, c *spotify.Client, tracks []spotify.FullTrack) (int, error) {
+	// UserHasTracks and AddTracksToLibrary take at most 50 IDs.
+	const batchSize = 50
+	liked := 0
+	for i := 0; i < len(tracks); i += batchSize {
+		end := i + batchSize
+		if end > len(tracks) {
+			end = len(tracks)
+		}
+		ids := make([]spotify.ID, 0, end-i)
+		for _, t := range tracks[i:end] {
+			ids = append(ids, t.ID)
+		}
+		has, err := c.UserHasTracks(ctx, ids...)
+		if err != nil {
+			return liked, fmt.Errorf("UserHasTracks(ctx): %v", err)
+		}
+		var add []spotify.ID
+		for j, id := range ids {
+			if !has[j] {
+				add = append(add, id)
+			}
+		}
+		if len(add) == 0 {
+			continue
+		}
+		if err := c.AddTracksToLibrary(ctx, add...); err != nil {
+			return liked, fmt.Errorf("AddTracksToLibrary(ctx): %v", err)
+		}
+		liked += len(add)
+	}
+	return liked, nil
+}
+
+// clearPlaylist empties the playlist, episodes included, with a single replace call. It's
+// much faster than purgeTracks on large playlists but doesn't look at what it removes.
+func clearPlaylist(ctx context.Context, c *spotify.Client, playlistID spotify.ID, retries int) error {
+	op := func() error {
+		return c.ReplacePlaylistTracks(ctx, playlistID)
+	}
+	if err := retrySpotify(ctx, retries, op); err != nil {
+		return fmt.Errorf("ReplacePlaylistTracks(ctx,%v): %v", redact(string(playlistID)), err)
+	}
+	return nil
+}
+
+// purgeDuplicates removes every repeat of a track on the playlist, keeping its first
+// occurrence, and returns how many were removed. Repeats are removed by position so the
+// first copy stays where it is.
+func purgeDuplicates(ctx context.Context, c spotifyAPI, playlist spotify.SimplePlaylist, retries int, dryRun bool) (int, error) {
+	items, err := getAllPlaylistItems(ctx, c, playlist.ID, playlistItemTypes(false))
+	if err != nil {
+		return 0, err
+	}
+	seen := make(map[spotify.ID]bool)
+	var dupes []spotify.TrackToRemove
+	for i, v := range items {
+		if itemKind(v) != "track" {
+			continue
+		}
+		t := v.Track.Track
+		if !seen[t.ID] {
+			seen[t.ID] = true
+			continue
+		}
+		if dryRun {
+			fmt.Fprintf(textOut(), "  %v (%v) at position %d\n", redact(trackName(*t)), redact(string(t.ID)), i)
+		}
+		dupes = append(dupes, spotify.TrackToRemove{URI: string(t.URI), Positions: []int{i}})
+	}
+	if dryRun {
+		return len(dupes), nil
+	}
+	// As in purgeTracks, batches go from the end backwards so positions stay valid.
+	removed := 0
+	for end := len(dupes); end > 0; end -= 100 {
+		start := end - 100
+		if start < 0 {
+			start = 0
+		}
+		batch := dupes[start:end]
+		op := func() error {
+			_, err := c.RemoveTracksFromPlaylistOpt(ctx, playlist.ID, batch, "")
+			return err
+		}
+		if err := retrySpotify(ctx, retries, op); err != nil {
+			return removed, fmt.Errorf("RemoveTracksFromPlaylistOpt(ctx,%v): %v", redact(string(playlist.ID)), err)
+		}
+		removed += len(batch)
+	}
+	return removed, nil
+}
+
+// purgeTracks removes the tracks on the playlist, and its podcast episodes as well
+// when episodes is set. A non-zero cutoff keeps the items added at or after it.
+func purgeTracks(ctx context.Context, c spotifyAPI, playlist spotify.SimplePlaylist, episodes bool, cutoff time2.Time, retries int, dryRun bool) error {
+	items, err := getAllPlaylistItems(ctx, c, playlist.ID, playlistItemTypes(episodes))
+	if err != nil {
+		return err
+	}
+	// remove holds the positions of the items to remove, in playlist order.
+	var remove []int
+	for i, v := range items {
+		switch itemKind(v) {
+		case "":
+			continue
+		case "episode":
+			if !episodes {
+				continue
+			}
+		}
+		if cutoff.IsZero() {
+			remove = append(remove, i)
+			continue
+		}
+		added, err := time2.Parse(spotify.TimestampLayout, v.AddedAt)
+		if err != nil {
+			// Very old playlists have no added_at; without it the item is kept.
+			slog.Debug("keeping item without an added date", "playlist", playlist.Name, "position", i, "added_at", v.AddedAt)
+			continue
+		}
+		if added.Before(cutoff) {
+			remove = append(remove, i)
+		}
+	}
+	if dryRun {
+		fmt.Fprintf(textOut(), "dry run: would remove %d items from %v\n", len(remove), playlist.Name)
+		for _, i := range remove {
+			v := items[i]
+			switch {
+			case v.Track.Episode != nil:
+				fmt.Fprintf(textOut(), "  episode: %v (%v)\n", redact(v.Track.Episode.Name), redact(string(v.Track.Episode.ID)))
+			case itemKind(v) == "episode":
+				fmt.Fprintf(textOut(), "  episode: %v (%v)\n", redact(v.Track.Track.Name), redact(string(v.Track.Track.ID)))
+			default:
+				fmt.Fprintf(textOut(), "  %v (%v)\n", redact(trackName(*v.Track.Track)), redact(string(v.Track.Track.ID)))
+			}
+		}
+		return nil
+	}
+	var plTrackIDs []spotify.ID
+	var byPosition []spotify.TrackToRemove
+	for _, i := range remove {
+		v := items[i]
+		// RemoveTracksFromPlaylist builds track URIs from IDs, so only Spotify tracks can
+		// go through it. Episodes and local files are removed by their own URI, and so
+		// are tracks with a cutoff: removing by ID would also take copies added after it.
+		// items holds every page, so i is the item's position in the whole playlist.
+		if itemKind(v) == "track" && cutoff.IsZero() {
+			plTrackIDs = append(plTrackIDs, v.Track.Track.ID)
+			continue
+		}
+		byPosition = append(byPosition, spotify.TrackToRemove{URI: string(itemURI(v)), Positions: []int{i}})
+	}
+	// Remove the items taken by position first so their positions are still valid. The
+	// API takes at most 100 items per call, so the batches go from the end of the playlist
+	// backwards: removing later items doesn't move the earlier ones.
+	for end := len(byPosition); end > 0; end -= 100 {
+		start := end - 100
+		if start < 0 {
+			start = 0
+		}
+		batch := byPosition[start:end]
+		op := func() error {
+			_, err := c.RemoveTracksFromPlaylistOpt(ctx, playlist.ID, batch, "")
+			return err
+		}
+		if err := retrySpotify(ctx, retries, op); err != nil {
+			return fmt.Errorf("RemoveTracksFromPlaylistOpt(ctx,%v): %v", redact(string(playlist.ID)), err)
+		}
+	}
+	for start := 0; start < len(plTrackIDs); start += 100 {
+		end := start + 100
+		if end > len(plTrackIDs) {
+			end = len(plTrackIDs)
+		}
+		batch := plTrackIDs[start:end]
+		op := func() error {
+			_, err := c.RemoveTracksFromPlaylist(ctx, playlist.ID, batch...)
+			return err
+		}
+		if err := retrySpotify(ctx, retries, op); err != nil {
+			return fmt.Errorf("RemoveTracksFromPlaylist(ctx,%v): %v", redact(string(playlist.ID)), err)
+		}
+	}
+	report.add(playlist.Name, func(rc *playlistCounts) { rc.Removed += len(remove) })
+	return nil
+}
+
+// parseID extracts the ID of a Spotify object of the given kind ("playlist", "track",
+// ...) from a URL (https://open.spotify.com/<kind>/<id>), URI (spotify:<kind>:<id>), or
+// bare ID. Every flag that takes an ID should go through it.
+func parseID(kind, s string) (spotify.ID, error) {
+	s = strings.TrimSpace(s)
+	id := s
+	m := spotifyURL.FindStringSubmatch(s)
+	if m == nil {
+		m = spotifyURI.FindStringSubmatch(s)
+	}
+	if m != nil {
+		if m[1] != kind {
+			return "", fmt.Errorf("%q is a %v, not a %v", s, m[1], kind)
+		}
+		id = m[2]
+	}
+	if !spotifyID.MatchString(id) {
+		return "", fmt.Errorf("%q is not a valid %v ID, URI, or URL", s, kind)
+	}
+	return spotify.ID(id), nil
+}
+
+// parsePlaylistID is parseID for playlists.
+func parsePlaylistID(s string) (spotify.ID, error) {
+	return parseID("playlist", s)
+}
+
+// allCurrentPlaylists returns every playlist the user owns or follows, following pagination.
+func allCurrentPlaylists(ctx context.Context, c spotifyAPI) ([]spotify.SimplePlaylist, error) {
+	var playlists []spotify.SimplePlaylist
+	for {
+		page, err := c.CurrentUsersPlaylists(ctx, spotify.Limit(50), spotify.Offset(len(playlists)))
+		if err != nil {
+			return nil, err
+		}
+		playlists = append(playlists, page.Playlists...)
+		if page.Next == "" || len(page.Playlists) == 0 {
+			return playlists, nil
+		}
+	}
+}
+
+// choose asks the user to pick one of n options, numbered from 1, on stdin. It returns
+// 0 if the answer is empty or not a valid choice. --timeout is paused while it waits.
+func choose(question string, n int) int {
+	defer runTimeout.pause()()
+	fmt.Printf("%v [1-%d, Enter to skip]: ", question, n)
+	var answer string
+	if _, err := fmt.Scanln(&answer); err != nil {
+		return 0
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(answer))
+	if err != nil || i < 1 || i > n {
+		return 0
+	}
+	return i
+}
+
+// duplicateNames groups the playlists whose names differ at most in case or surrounding
+// whitespace, keeping only groups with more than one playlist. Groups are in the order
+// their first playlist appears.
+func duplicateNames(playlists []spotify.SimplePlaylist) [][]spotify.SimplePlaylist {
+	var keys []string
+	groups := make(map[string][]spotify.SimplePlaylist)
+	for _, v := range playlists {
+		key := strings.ToLower(strings.TrimSpace(v.Name))
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], v)
+	}
+	var dups [][]spotify.SimplePlaylist
+	for _, k := range keys {
+		if len(groups[k]) > 1 {
+			dups = append(dups, groups[k])
+		}
+	}
+	return dups
+}
+
+// confirm asks the user a yes/no question on stdin. Anything other than y or yes is a no.
+// --timeout is paused while it waits.
+func confirm(question string) bool {
+	defer runTimeout.pause()()
+	fmt.Printf("%v [y/N]: ", question)
+	var answer string
+	if _, err := fmt.Scanln(&answer); err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// preferredPlaylist picks between two playlists with the same name. Playlists owned by
+// the user win, then the one with the most tracks, then the lowest ID so the choice is
+// stable between runs.
+func preferredPlaylist(userID string, a, b spotify.SimplePlaylist) spotify.SimplePlaylist {
+	aOwned, bOwned := a.Owner.ID == userID, b.Owner.ID == userID
+	if aOwned != bOwned {
+		if aOwned {
+			return a
+		}
+		return b
+	}
+	if a.Tracks.Total != b.Tracks.Total {
+		if a.Tracks.Total > b.Tracks.Total {
+			return a
+		}
+		return b
+	}
+	if a.ID < b.ID {
+		return a
+	}
+	return b
+}
+
+// automatedPlaylistNames are the names of the playlists managed by the tool.
+var automatedPlaylistNames = []string{"Favorite Short Term Tracks", "Favorite Medium Term Tracks", "Favorite Long Term Tracks"}
+
+// Sources of the tracks on the automated playlists.
+const (
+	sourceTracks  = "tracks"
+	sourceArtists = "artists"
+)
+
+// automatedSet describes one set of automated playlists, one per term.
+type automatedSet struct {
+	source string
+	// names are the playlist names, in terms order.
+	names []string
+	// match matches any of the set's playlists.
+	match *regexp.Regexp
+	// termRes match each term's playlist, in terms order.
+	termRes []*regexp.Regexp
+	// ranges are the terms of the playlists, normally all of terms but just one with
+	// --term.
+	ranges []spotify.Range
+	// dated matches the set's playlists, including those created by --dated.
+	dated *regexp.Regexp
+	// specs, if set, configure each term's playlist when it's created, in terms order.
+	specs []playlistSpec
+}
+
+// only returns a copy of s with just the playlist for term, so the others are neither
+// created nor filled.
+func (s automatedSet) only(term spotify.Range) (automatedSet, error) {
+	for i, r := range s.ranges {
+		if r != term {
+			continue
+		}
+		one := s
+		one.names = []string{s.names[i]}
+		one.termRes = []*regexp.Regexp{s.termRes[i]}
+		one.ranges = []spotify.Range{r}
+		if s.specs != nil {
+			one.specs = []playlistSpec{s.specs[i]}
+		}
+		one.match = regexp.MustCompile("(?i)^\\s*" + regexp.QuoteMeta(s.names[i]) + "\\s*$")
+		one.dated = s.termRes[i]
+		return one, nil
+	}
+	return s, fmt.Errorf("no %v term playlist in the set", term)
+}
+
+// withVisibility returns a copy of s whose playlists are created public or collaborative
+// as given, overriding any --config settings.
+func (s automatedSet) withVisibility(public, collaborative bool) automatedSet {
+	specs := make([]playlistSpec, len(s.names))
+	for i := range s.names {
+		if s.specs != nil {
+			specs[i] = s.specs[i]
+		}
+		specs[i].Public = public
+		specs[i].Collaborative = collaborative
+	}
+	s.specs = specs
+	return s
+}
+
+// withSuffix returns a copy of s whose playlists are named with suffix after a space,
+// e.g. "Favorite Short Term Tracks 2024-06", and matched by that name alone, so the
+// suffixed playlists are filled and purged apart from the unsuffixed ones.
+func (s automatedSet) withSuffix(suffix string) automatedSet {
+	names := make([]string, len(s.names))
+	termRes := make([]*regexp.Regexp, len(s.names))
+	var quoted []string
+	for i, name := range s.names {
+		names[i] = name + " " + suffix
+		q := regexp.QuoteMeta(names[i])
+		termRes[i] = regexp.MustCompile("(?i)^\\s*" + q + "\\s*$")
+		quoted = append(quoted, q)
+	}
+	s.names = names
+	s.termRes = termRes
+	s.match = regexp.MustCompile("(?i)^\\s*(" + strings.Join(quoted, "|") + ")\\s*$")
+	s.dated = s.match
+	return s
+}
+
+// namedSet returns a set of one playlist called name, filled from the top tracks of
+// term, for the custom command.
+func namedSet(name string, term spotify.Range) automatedSet {
+	name = strings.TrimSpace(name)
+	re := regexp.MustCompile("(?i)^\\s*" + regexp.QuoteMeta(name) + "\\s*$")
+	return automatedSet{
+		source:  sourceTracks,
+		names:   []string{name},
+		match:   re,
+		termRes: []*regexp.Regexp{re},
+		ranges:  []spotify.Range{term},
+		dated:   re,
+	}
+}
+
+// suffixLayout matches the date templates in --name-suffix, e.g. {2006-01}.
+var suffixLayout = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// expandSuffix replaces each {layout} in suffix with now formatted by that Go time
+// layout, so "{2006-01}" becomes e.g. "2024-06".
+func expandSuffix(suffix string, now time2.Time) string {
+	return strings.TrimSpace(suffixLayout.ReplaceAllStringFunc(suffix, func(m string) string {
+		return now.Format(m[1 : len(m)-1])
+	}))
+}
+
+// spec returns how to create the i'th playlist of the set. Without specs the playlist is
+// private, not collaborative, and given description.
+func (s automatedSet) spec(i int, description string) playlistSpec {
+	if s.specs == nil {
+		return playlistSpec{Name: s.names[i], Description: description}
+	}
+	sp := s.specs[i]
+	sp.Name = s.names[i]
+	if sp.Description == "" {
+		sp.Description = description
+	}
+	return sp
+}
+
+// allRanges are the durations of terms, in order.
+var allRanges = []spotify.Range{spotify.ShortTermRange, spotify.MediumTermRange, spotify.LongTermRange}
+
+var (
+	trackPlaylists = automatedSet{
+		source:  sourceTracks,
+		names:   automatedPlaylistNames,
+		match:   plMatch,
+		termRes: []*regexp.Regexp{shortTermRe, medTermRe, longTermRe},
+		ranges:  allRanges,
+		dated:   plMatchDated,
+	}
+	artistPlaylists = automatedSet{
+		source:  sourceArtists,
+		names:   []string{"Favorite Short Term Artists", "Favorite Medium Term Artists", "Favorite Long Term Artists"},
+		match:   plMatchArtists,
+		termRes: []*regexp.Regexp{shortTermArtistsRe, medTermArtistsRe, longTermArtistsRe},
+		ranges:  allRanges,
+		dated:   plMatchArtistsDated,
+	}
+)
+
+// createDatedPlaylists creates a new set of automated playlists whose names are suffixed
+// with the month of now, e.g. "Favorite Short Term Tracks 2024-06". Existing playlists
+// are never reused, so each run leaves the previous ones as archives. With dryRun
+// nothing is created and placeholders are returned instead, see placeholderPlaylist.
+func createDatedPlaylists(ctx context.Context, c spotifyAPI, user *spotify.PrivateUser, set automatedSet, description string, now time2.Time, dryRun bool) ([]spotify.SimplePlaylist, error) {
+	var created []spotify.SimplePlaylist
+	for i := range set.names {
+		sp := set.spec(i, description)
+		name := sp.Name + " " + now.Format("2006-01")
+		if dryRun {
+			sp.Name = name
+			created = append(created, placeholderPlaylist(sp))
+			continue
+		}
+		pl, err := c.CreatePlaylistForUser(ctx, user.ID, name, sp.Description, sp.Public, sp.Collaborative)
+		if err != nil {
+			return nil, fmt.Errorf("CreatePlaylistForUser(ctx,%v,%v,%v,%v,%v): %v", redact(user.ID), name, sp.Description, sp.Public, sp.Collaborative, err)
+		}
+		created = append(created, pl.SimplePlaylist)
+	}
+	return created, nil
+}
+
+// placeholderPlaylist stands in for a playlist that a dry run would create. It has no
+// ID, so it's previewed as an empty playlist and skipped by anything that would read
+// or change it on Spotify.
+func placeholderPlaylist(sp playlistSpec) spotify.SimplePlaylist {
+	fmt.Fprintf(textOut(), "dry run: would create %v\n", sp.Name)
+	return spotify.SimplePlaylist{Name: sp.Name, Description: sp.Description, IsPublic: sp.Public, Collaborative: sp.Collaborative}
+}
+
+// datedPlaylists returns the playlists of set created by --dated.
+func datedPlaylists(set automatedSet, playlists []spotify.SimplePlaylist) []spotify.SimplePlaylist {
+	var found []spotify.SimplePlaylist
+	for _, v := range playlists {
+		if set.dated.MatchString(v.Name) && !set.match.MatchString(v.Name) {
+			found = append(found, v)
+		}
+	}
+	return found
+}
+
+// TODO(dduclayan): This should probably be renamed to something else, as it's getting and creating the playlists if
+// they are not found.
+//
+// With dryRun the missing playlists aren't created; placeholders stand in for them.
+func getAutomatedPlaylists(ctx context.Context, c spotifyAPI, user *spotify.PrivateUser, set automatedSet, playlists []spotify.SimplePlaylist, description string, dryRun bool) ([]spotify.SimplePlaylist, error) {
+	var foundPlaylists []spotify.SimplePlaylist
+	byName := make(map[string]int)
+	duplicates := make(map[string]bool)
+	for _, v := range playlists {
+		if !set.match.MatchString(v.Name) {
+			continue
+		}
+		// Names differing only in case or whitespace are the same playlist to the matchers.
+		key := strings.ToLower(strings.TrimSpace(v.Name))
+		if i, ok := byName[key]; ok {
+			foundPlaylists[i] = preferredPlaylist(user.ID, foundPlaylists[i], v)
+			duplicates[key] = true
+			continue
+		}
+		byName[key] = len(foundPlaylists)
+		foundPlaylists = append(foundPlaylists, v)
+	}
+	for _, v := range foundPlaylists {
+		if !duplicates[strings.ToLower(strings.TrimSpace(v.Name))] {
+			continue
+		}
+		if v.Owner.ID != user.ID {
+			return nil, fmt.Errorf("found multiple playlists named %q and none are owned by %v, please rename or unfollow the extras", v.Name, redact(user.ID))
+		}
+		slog.Warn("found multiple playlists with the same name", "name", v.Name, "using", redact(string(v.ID)), "tracks", v.Tracks.Total)
+	}
+	// Each term's playlist is created only if it's missing, so a run that failed partway
+	// through creating them is completed by the next one instead of leaving gaps.
+	for i := range set.names {
+		if hasTermPlaylist(set.termRes[i], foundPlaylists) {
+			continue
+		}
+		sp := set.spec(i, description)
+		if dryRun {
+			foundPlaylists = append(foundPlaylists, placeholderPlaylist(sp))
+			continue
+		}
+		pl, err := c.CreatePlaylistForUser(ctx, user.ID, sp.Name, sp.Description, sp.Public, sp.Collaborative)
+		if err != nil {
+			return nil, fmt.Errorf("CreatePlaylistForUser(ctx,%v,%v,%v,%v,%v): %v", redact(user.ID), sp.Name, sp.Description, sp.Public, sp.Collaborative, err)
+		}
+		slog.Info("created missing playlist", "playlist", sp.Name)
+		foundPlaylists = append(foundPlaylists, pl.SimplePlaylist)
+	}
+	return foundPlaylists, nil
+}
+
+// hasTermPlaylist reports whether any of playlists matches a term's regexp.
+func hasTermPlaylist(re *regexp.Regexp, playlists []spotify.SimplePlaylist) bool {
+	for _, v := range playlists {
+		if re.MatchString(v.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedAutomatedPlaylists returns the automated playlists of set whose IDs were saved
+// by an earlier run, checking with a GetPlaylist each that they still exist, still have
+// exactly their term's name, and are still followed by the user. It reports false if
+// anything is missing or stale, and the playlists should be looked up by listing instead.
+func cachedAutomatedPlaylists(ctx context.Context, c *spotify.Client, user *spotify.PrivateUser, set automatedSet, st *runState) ([]spotify.SimplePlaylist, bool) {
+	ids := st.Playlists[user.ID][set.cacheKey()]
+	if len(ids) != len(set.names) {
+		return nil, false
+	}
+	var found []spotify.SimplePlaylist
+	for i, id := range ids {
+		pl, err := c.GetPlaylist(ctx, spotify.ID(id), spotify.Fields("id,name,description,public,collaborative,snapshot_id,owner(id),tracks(total)"))
+		if err != nil {
+			slog.Debug("cached playlist is gone", "id", redact(id), "err", err)
+			return nil, false
+		}
+		// The term regexps also accept --dated suffixes, which would let a cached
+		// "... 2024-06" snapshot pass for the plain playlist, so names must match exactly.
+		if !sameName(pl.Name, set.names[i]) {
+			slog.Debug("cached playlist was renamed", "id", redact(id), "name", pl.Name)
+			return nil, false
+		}
+		follows, err := c.UserFollowsPlaylist(ctx, pl.ID, user.ID)
+		if err != nil || len(follows) == 0 || !follows[0] {
+			slog.Debug("cached playlist isn't followed", "id", redact(id), "err", err)
+			return nil, false
+		}
+		found = append(found, pl.SimplePlaylist)
+	}
+	return found, true
+}
+
+// cacheKey identifies the set in the playlist ID cache. It includes the names, so sets
+// sharing a source, e.g. --name-suffix snapshots or a custom playlist, don't replace
+// each other's entries.
+func (s automatedSet) cacheKey() string {
+	names := make([]string, len(s.names))
+	for i, name := range s.names {
+		names[i] = strings.ToLower(strings.TrimSpace(name))
+	}
+	return s.source + ":" + strings.Join(names, "|")
+}
+
+// sameName reports whether two playlist names are the same to the matchers, ignoring
+// case and surrounding whitespace.
+func sameName(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// cacheAutomatedPlaylists saves the IDs of playlists, the automated playlists of set, in
+// st for cachedAutomatedPlaylists. Nothing is saved unless each term has its playlist.
+func cacheAutomatedPlaylists(user *spotify.PrivateUser, set automatedSet, playlists []spotify.SimplePlaylist, st *runState) {
+	ids := make([]string, len(set.names))
+	for _, v := range playlists {
+		for i, name := range set.names {
+			if sameName(v.Name, name) {
+				ids[i] = string(v.ID)
+			}
+		}
+	}
+	for _, id := range ids {
+		if id == "" {
+			return
+		}
+	}
+	if st.Playlists == nil {
+		st.Playlists = make(map[string]map[string][]string)
+	}
+	if st.Playlists[user.ID] == nil {
+		st.Playlists[user.ID] = make(map[string][]string)
+	}
+	st.Playlists[user.ID][set.cacheKey()] = ids
+}
+
+// termConfigs builds the configs for the terms of set, normally short, medium, and long
+// in that order, from the automated playlists in set.
+func termConfigs(user *spotify.PrivateUser, set automatedSet, automatedPlaylists []spotify.SimplePlaylist) []playlistConfig {
+	configs := make([]playlistConfig, len(set.ranges))
+	for _, v := range automatedPlaylists {
+		for i, r := range set.ranges {
+			if !set.termRes[i].MatchString(v.Name) {
+				continue
+			}
+			configs[i] = playlistConfig{
+				name:          v.Name,
+				public:        v.IsPublic,
+				description:   v.Description,
+				collaborative: v.Collaborative,
+				duration:      r,
+				user:          user,
+				id:            v.ID,
+				snapshotID:    v.SnapshotID,
+				source:        set.source,
+			}
+		}
+	}
+	return configs
+}
+
+// refreshIfStale replaces the playlist's contents with the current top tracks if its
+// staleness, the share of tracks not in common between the two, is above threshold.
+// It reports whether the playlist was refreshed, along with the staleness.
+func refreshIfStale(ctx context.Context, c *spotify.Client, p playlistConfig, threshold float64) (bool, float64, error) {
+	top, err := p.getTopTracks(ctx, c)
+	if err != nil {
+		return false, 0, err
+	}
+	if top == nil {
+		return false, 0, nil
+	}
+	items, err := getAllPlaylistItems(ctx, c, p.id, playlistItemTypes(false))
+	if err != nil {
+		return false, 0, err
+	}
+	var plTracks []spotify.FullTrack
+	for _, v := range items {
+		if itemKind(v) == "track" {
+			plTracks = append(plTracks, *v.Track.Track)
+		}
+	}
+	_, similarity := overlap(top.Tracks, plTracks)
+	staleness := 1 - similarity
+	if staleness <= threshold {
+		return false, staleness, nil
+	}
+	var ids []spotify.ID
+	for _, t := range top.Tracks {
+		ids = append(ids, t.ID)
+	}
+	if err := replacePlaylistTracks(ctx, c, p.id, ids); err != nil {
+		return false, staleness, err
+	}
+	return true, staleness, nil
+}
+
+// fillPlan holds everything a fill reads from Spotify, so it can be gathered before
+// any playlist is modified.
+type fillPlan struct {
+	tracks *spotify.FullTrackPage
+	skip   map[spotify.ID]bool
+	// recommended are the tracks added by --recommend after tracks.
+	recommended *spotify.FullTrackPage
+}
+
+// all returns the tracks of plan followed by the recommended ones.
+func (plan fillPlan) all() *spotify.FullTrackPage {
+	if plan.recommended == nil || len(plan.recommended.Tracks) == 0 {
+		return plan.tracks
+	}
+	page := *plan.tracks
+	page.Tracks = append(append([]spotify.FullTrack(nil), plan.tracks.Tracks...), plan.recommended.Tracks...)
+	return &page
+}
+
+// planFill fetches the top tracks for p and the tracks
+// already on the playlist. It doesn't modify anything.
+func planFill(ctx context.Context, c *spotify.Client, p playlistConfig) (fillPlan, error) {
+	defer phases.since("fetch top tracks", time2.Now())
+	tt, err := p.getTopTracks(ctx, c)
+	if err != nil {
+		return fillPlan{}, fmt.Errorf("getTopTracks(): %v\n", err)
+	}
+	if tt == nil {
+		// getTopTracks already warned; with no page there is nothing to fill with.
+		return fillPlan{}, nil
+	}
+	tt, excluded := filterTracks(tt, p.filter)
+	if excluded > 0 {
+		slog.Info("excluded tracks by filter", "playlist", p.name, "excluded", excluded)
+	}
+	unfiltered := len(tt.Tracks)
+	if tt, err = filterByFeatures(ctx, c, tt, p.name, p.minEnergy, p.minDanceability); err != nil {
+		return fillPlan{}, fmt.Errorf("filterByFeatures(): %v\n", err)
+	}
+	report.add(p.name, func(rc *playlistCounts) { rc.Filtered += excluded + unfiltered - len(tt.Tracks) })
+	// Sampling comes last so it picks from the tracks that passed the filters.
+	tt = sampleTracks(tt, p.name, p.sample, p.seed)
+	tt = sortTracks(tt, p.sortBy)
+	// Tracks already on the playlist are skipped so repeated fills don't pile up duplicates.
+	plan := fillPlan{tracks: tt}
+	// A playlist a dry run would create has no ID and nothing on it yet.
+	if !p.replace && p.id != "" {
+		if plan.skip, err = existingTrackIDs(ctx, c, p.id); err != nil {
+			return fillPlan{}, fmt.Errorf("existingTrackIDs(): %v\n", err)
+		}
+	}
+	if p.recommend > 0 {
+		if plan.recommended, err = recommendTracks(ctx, c, tt, p.recommendGenres, p.recommend, plan.skip); err != nil {
+			return fillPlan{}, fmt.Errorf("recommendTracks(): %v\n", err)
+		}
+		slog.Info("recommended tracks", "playlist", p.name, "tracks", len(plan.recommended.Tracks))
+	}
+	return plan, nil
+}
+
+// replaceFill sets p's playlist to exactly the tracks on page, in order, with one
+// ReplacePlaylistTracks call, so a failure leaves the old contents in place rather
+// than a half-emptied playlist. Tracks listed twice are added once.
+func replaceFill(ctx context.Context, c *spotify.Client, p playlistConfig, page *spotify.FullTrackPage) (fillResult, error) {
+	var res fillResult
+	var ids []spotify.ID
+	seen := make(map[spotify.ID]bool, len(page.Tracks))
+	for _, t := range page.Tracks {
+		if seen[t.ID] {
+			res.skipped++
+			continue
+		}
+		seen[t.ID] = true
+		ids = append(ids, t.ID)
+		res.addedTracks = append(res.addedTracks, trackName(t))
+	}
+	op := func() error {
+		return replacePlaylistTracks(ctx, c, p.id, ids)
+	}
+	if err := retrySpotify(ctx, p.retries, op); err != nil {
+		res.failed = len(ids)
+		res.addedTracks = nil
+		return res, err
+	}
+	res.added = len(ids)
+	return res, nil
+}
+
+// applyFill makes the changes described by plan to p's playlist.
+func applyFill(ctx context.Context, c *spotify.Client, p playlistConfig, plan fillPlan) (fillResult, error) {
+	defer phases.since("fill", time2.Now())
+	if plan.tracks == nil {
+		// Leave the playlist alone, even with --replace, rather than empty it.
+		return fillResult{}, nil
+	}
+	if p.dryRun {
+		res, err := fillPlaylist(ctx, c, p.id, p.name, plan.tracks, plan.skip, p.retries, true)
+		if err != nil {
+			return res, err
+		}
+		// Build the preview first so concurrent fills don't interleave their lines.
+		var b strings.Builder
+		verb := "add"
+		if p.replace {
+			verb = "replace the contents with"
+		}
+		fmt.Fprintf(&b, "dry run: would %v %d tracks to %v\n", verb, res.added, p.name)
+		for _, name := range res.addedTracks {
+			fmt.Fprintf(&b, "  %v\n", redact(name))
+		}
+		if plan.recommended != nil {
+			// recommendTracks already left out the top tracks and those in skip.
+			recs, _ := fillPlaylist(ctx, c, p.id, p.name, plan.recommended, nil, p.retries, true)
+			fmt.Fprintf(&b, "dry run: and %d recommended tracks\n", recs.added)
+			for _, name := range recs.addedTracks {
+				fmt.Fprintf(&b, "  [recommended] %v\n", redact(name))
+			}
+			res.added += recs.added
+			res.addedTracks = append(res.addedTracks, recs.addedTracks...)
+		}
+		fmt.Fprint(textOut(), b.String())
+		return res, nil
+	}
+	if p.newDescription != "" {
+		if err := c.ChangePlaylistDescription(ctx, p.id, p.newDescription); err != nil {
+			return fillResult{}, fmt.Errorf("ChangePlaylistDescription(ctx,%v,%v): %v\n", redact(string(p.id)), p.newDescription, err)
+		}
+	}
+	var res fillResult
+	var err error
+	if p.replace {
+		res, err = replaceFill(ctx, c, p, plan.all())
+	} else {
+		res, err = fillPlaylist(ctx, c, p.id, p.name, plan.all(), plan.skip, p.retries, false)
+	}
+	if err != nil {
+		return res, fmt.Errorf("fillPlaylist(): %v\n", err)
+	}
+	if p.maintainRank {
+		if err := rankPlaylist(ctx, c, p.id, plan.tracks); err != nil {
+			return res, fmt.Errorf("rankPlaylist(): %v\n", err)
+		}
+	}
+	if p.sortFinal != "" {
+		if err := sortPlaylist(ctx, c, p.id, p.sortFinal); err != nil {
+			return res, fmt.Errorf("sortPlaylist(): %v\n", err)
+		}
+	}
+	return res, nil
+}
+
+func getTopTracksAndFill(ctx context.Context, c *spotify.Client, p playlistConfig) (fillResult, error) {
+	plan, err := planFill(ctx, c, p)
+	if err != nil {
+		return fillResult{}, err
+	}
+	return applyFill(ctx, c, p, plan)
+}
+
+// loginCompletedPage is served once auth completes. It tries to close its own tab, and
+// still reads fine when scripts are disabled or the browser refuses to close it.
+const loginCompletedPage = `<!DOCTYPE html>
+<html>
+<head><title>top_tracks_cli</title></head>
+<body>
+<p>Login Completed!</p>
+<p id="hint">You can close this tab.</p>
+<script>
+window.close();
+document.getElementById("hint").textContent = "You can close this tab if it didn't close on its own.";
+</script>
+</body>
+</html>
+`
+
+// newState returns a random OAuth state for a single run, so a callback left over from
+// an earlier, interrupted login can't complete this one.
+func newState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("rand.Read(): %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// currentUser returns the logged in user, retrying with b. A user without an ID is an
+// error, and retried too: playlists are created under user.ID, which fails obscurely if
+// it's empty.
+func currentUser(ctx context.Context, c *spotify.Client, b backoff.BackOff) (*spotify.PrivateUser, error) {
+	var user *spotify.PrivateUser
+	op := func() error {
+		var err error
+		user, err = c.CurrentUser(ctx)
+		if err != nil {
+			return fmt.Errorf("CurrentUser(ctx): %v", err)
+		}
+		if user.ID == "" {
+			return fmt.Errorf("Spotify returned a user without an ID")
+		}
+		return nil
+	}
+	if err := retryNotify(op, b); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// checkState returns an error if the callback's state isn't the one this run sent.
+func checkState(r *http.Request, state string) error {
+	if st := r.FormValue("state"); st != state {
+		return fmt.Errorf("state mismatch: got %q, want %q", st, state)
+	}
+	return nil
+}
+
+// completeAuth returns the OAuth callback handler for a login started with state and,
+// in PKCE mode, the code verifier whose challenge was sent with it. A
+// callback with a different state, e.g. from a previous run's browser tab, is rejected
+// and the run keeps waiting for the right one. Other failures are shown to the browser
+// and sent on errCh for main to report.
+func completeAuth(state, verifier string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkState(r, state); err != nil {
+			http.Error(w, "Stale or unknown login, please retry from the latest login page", http.StatusForbidden)
+			slog.Warn("rejected login callback", "err", err)
+			return
+		}
+		var opts []oauth2.AuthCodeOption
+		if verifier != "" {
+			opts = append(opts, oauth2.VerifierOption(verifier))
+		}
+		tok, err := auth.Token(withHTTPTimeout(r.Context()), state, r, opts...)
+		if err != nil {
+			http.Error(w, "Couldn't complete the login, see the terminal for details", http.StatusForbidden)
+			errCh <- fmt.Errorf("auth.Token(): %v", err)
+			return
+		}
+
+		// Cache the token so the next run can skip the browser.
+		if path, err := tokenCachePath(); err != nil {
+			slog.Warn("couldn't cache the login token", "err", err)
+		} else if err := saveToken(path, tok); err != nil {
+			slog.Warn("couldn't cache the login token", "path", path, "err", err)
+		}
+
+		// use the token to get an authenticated client
+		client := newAPIClient(tok)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// The login has succeeded even if the page can't be written, so carry on.
+		if _, err := fmt.Fprint(w, loginCompletedPage); err != nil {
+			slog.Warn("couldn't write the login completed page", "err", err)
+		}
+		ch <- client
+	}
+}
+
+// browserLogin runs the browser login: it serves the callback on --port, prints the
+// login URL, and waits up to --auth_timeout for the callback. The callback server is
+// shut down before returning, freeing the port for a later login.
+func browserLogin(state string) (*spotify.Client, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *authPort))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't listen on port %d for the login callback, is it already in use? Pick another with --port and register the new redirect URI for the app. (%v)", *authPort, err)
+	}
+	var verifier string
+	var authOpts []oauth2.AuthCodeOption
+	if pkceMode() {
+		verifier = oauth2.GenerateVerifier()
+		authOpts = append(authOpts, oauth2.S256ChallengeOption(verifier))
+		slog.Info("logging in with PKCE, no client secret is used")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(*callbackPath, completeAuth(state, verifier))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		slog.Debug("unexpected request to the callback server", "url", r.URL.String())
+	})
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			errCh <- fmt.Errorf("login callback server stopped: %v", err)
+		}
+	}()
+	defer func() {
+		// The login page has been written by the time the client arrives, so this only
+		// waits for stray requests, e.g. a favicon.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time2.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("couldn't shut down the login callback server", "err", err)
+		}
+	}()
+
+	url := auth.AuthURL(state, authOpts...)
+	// xdg-open can start fine and still show nothing, e.g. over SSH, so the URL is
+	// printed either way.
+	if err := openBrowser(url); err != nil {
+		slog.Warn("couldn't open a browser", "err", err)
+	}
+	fmt.Fprintf(os.Stderr, "Open this URL to authorize: %v\n", url)
+
+	// wait for auth to complete
+	select {
+	case client := <-ch:
+		return client, nil
+	case err := <-errCh:
+		return nil, fmt.Errorf("Login failed: %v. Run again to retry.", err)
+	case <-time2.After(*authTimeout):
+		return nil, fmt.Errorf("No login callback after %v. If no browser window opened, open this URL manually and run again:\n%v", *authTimeout, url)
+	}
+}
+
+// openBrowser opens url in the user's browser. The browser is started in the
+// background, so a nil error doesn't guarantee a window actually opened.
+func openBrowser(url string) error {
+	var err error
+
+	switch runtime.GOOS {
+	case "linux":
+		err = exec.Command("xdg-open", url).Start()
+	case "windows":
+		err = exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	case "darwin":
+		err = exec.Command("open", url).Start()
+	default:
+		err = fmt.Errorf("unsupported platform")
+	}
+	return err
+}
+
+// usage prints the top-level flags, leaving out hidden ones that have no usage text.
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Usage == "" {
+			return
+		}
+		fmt.Fprintf(flag.CommandLine.Output(), "  -%s\n    \t%s\n", f.Name, f.Usage)
+	})
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Println("expected a subcommand, e.g. 'playlist' or 'follow'")
+		os.Exit(1)
+	}
+	if err := setupLogging(*logLevel); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := checkProfile(*profile); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// Without these the login fails deep in the OAuth exchange with an unclear error.
+	if err := checkCredentials(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if err := migrateConfigDir(); err != nil {
+		slog.Warn("couldn't move the cached login into the default profile", "err", err)
+	}
+	// The authenticator depends on --pkce, so it's rebuilt now that flags are parsed.
+	auth = newAuthenticator(redirectURL(*authPort, *callbackPath))
+	start := time2.Now()
+	ctx := context.Background()
+	if *configFile != "" {
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			fmt.Printf("loadConfig(%v): %v\n", *configFile, err)
+			os.Exit(1)
+		}
+		trackPlaylists = cfg.trackSet()
+	}
+
+	// check_token and token_scopes must not start the browser auth flow, so they're
+	// handled up front.
+	if flag.Arg(0) == "check_token" {
+		if err := checkTokenCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse check_token flags")
+			os.Exit(1)
+		}
+		if *checkTokenFile == "" {
+			fmt.Println("--token_file is required")
+			os.Exit(1)
+		}
+		if err := checkToken(ctx, *checkTokenFile); err != nil {
+			fmt.Printf("checkToken(ctx,%v): %v\n", *checkTokenFile, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "token_scopes" {
+		if err := tokenScopesCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse token_scopes flags")
+			os.Exit(1)
+		}
+		if *tokenScopesFile == "" {
+			fmt.Println("--token_file is required")
+			os.Exit(1)
+		}
+		if err := tokenScopes(ctx, *tokenScopesFile); err != nil {
+			fmt.Printf("tokenScopes(ctx,%v): %v\n", *tokenScopesFile, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var client *spotify.Client
+	if *apiBase != "" {
+		base := *apiBase
+		if !strings.HasSuffix(base, "/") {
+			base += "/"
+		}
+		pacer.base = &userAgentTransport{base: http.DefaultTransport, userAgent: *userAgent}
+		apiCounter.base = pacer
+		client = spotify.New(&http.Client{Transport: apiCounter, Timeout: *httpTimeout}, spotify.WithBaseURL(base))
+	} else if !*reauth {
+		var err error
+		client, err = cachedClient(ctx)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("couldn't use the cached login, logging in again", "err", err)
+		}
+	}
+	if client == nil {
+		state := os.Getenv("spotify_state")
+		if state == "" {
+			var err error
+			state, err = newState()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			slog.Info("spotify_state is unset, generated a random OAuth state for this login")
+		}
+		if *authPort < 1 || *authPort > 65535 {
+			fmt.Printf("--port must be between 1 and 65535, got %d\n", *authPort)
+			os.Exit(1)
+		}
+		if !strings.HasPrefix(*callbackPath, "/") || *callbackPath == "/" {
+			fmt.Printf("--callback-path must start with / and name a path, got %q\n", *callbackPath)
+			os.Exit(1)
+		}
+		redirect := redirectURL(*authPort, *callbackPath)
+		// Spotify rejects logins whose redirect URI isn't registered for the app, with an
+		// unhelpful page, so catch a known mismatch up front.
+		if registered := os.Getenv("spotify_redirect_uri"); registered != "" && registered != redirect {
+			fmt.Printf("Redirect URI %v doesn't match the registered %v from spotify_redirect_uri; adjust --port and --callback-path\n", redirect, registered)
+			os.Exit(1)
+		}
+		auth = newAuthenticator(redirect)
+
+		var err error
+		if client, err = browserLogin(state); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	// The browser login can take a while, so --timeout only starts once it's done. --watch
+	// applies it to each run instead, starting from root.
+	root := ctx
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = runTimeout.start(ctx, *timeout)
+		defer cancel()
+	}
+
+	// use the client to make calls that require authorization
+	// A failure here would waste a completed browser login, so retry it a few times.
+	user, err := currentUser(ctx, client, newBackOff(ctx, currentUserRetries))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// Diagnostics are logged to stderr so --format json output on stdout stays clean.
+	slog.Info("logged in", "user", redact(user.ID))
+	phases.since("auth", start)
+
+	switch flag.Arg(0) {
+	case "playlist":
+		if err := playlistCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse playlist flags")
+			os.Exit(1)
+		}
+		limit, err := validateLimit("--limit", *playlistLimit, *playlistClampLimit)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// --count is the same setting as --limit but always caps with a warning.
+		if flagSet(playlistCmd, "count") {
+			if flagSet(playlistCmd, "limit") {
+				fmt.Println("--count and --limit can't be used together")
+				os.Exit(1)
+			}
+			if limit, err = validateLimit("--count", *playlistCount, true); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		excludeNames, excludeIDs, err := parseExclude(*playlistExclude)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		filter := trackFilter{
+			minDuration: time2.Duration(*playlistMinDuration) * time2.Second,
+			maxDuration: time2.Duration(*playlistMaxDuration) * time2.Second,
+			exclude:     excludeNames,
+			excludeIDs:  excludeIDs,
+			market:      *playlistMarket,
+		}
+		// Spotify calls the user's own market "from_token".
+		if filter.market == "from_token" {
+			filter.market = user.Country
+		}
+		if err := filter.validate(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		description := defaultDescription
+		if *playlistDescription != "" {
+			if n := utf8.RuneCountInString(*playlistDescription); n > maxDescriptionLength {
+				fmt.Printf("--description is %d characters, Spotify allows at most %d\n", n, maxDescriptionLength)
+				os.Exit(1)
+			}
+			description = *playlistDescription
+		}
+		set := trackPlaylists
+		if *playlistByArtist {
+			set = artistPlaylists
+		}
+		// Spotify only lets private playlists be collaborative.
+		if *playlistPublic && *playlistCollaborative {
+			fmt.Println("--public and --collaborative can't be used together: Spotify doesn't allow public collaborative playlists")
+			os.Exit(1)
+		}
+		if flagSet(playlistCmd, "public") || flagSet(playlistCmd, "collaborative") {
+			set = set.withVisibility(*playlistPublic, *playlistCollaborative)
+		}
+		if *playlistNameSuffix != "" {
+			if *playlistDated {
+				fmt.Println("--name-suffix and --dated can't be used together, use --name-suffix {2006-01} for monthly playlists")
+				os.Exit(1)
+			}
+			suffix := expandSuffix(*playlistNameSuffix, time2.Now())
+			if suffix == "" {
+				fmt.Printf("--name-suffix %q expands to nothing\n", *playlistNameSuffix)
+				os.Exit(1)
+			}
+			set = set.withSuffix(suffix)
+		}
+		if *playlistTerm != "all" {
+			term, err := termRange(*playlistTerm)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			if set, err = set.only(term); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		if *playlistSample < 0 {
+			fmt.Printf("--sample must not be negative, got %d\n", *playlistSample)
+			os.Exit(1)
+		}
+		seed := *playlistSeed
+		if seed == 0 {
+			seed = time2.Now().UnixNano()
+		}
+		if *playlistDedupTerms {
+			if _, err := termPriority(*playlistTermPriority); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		if *playlistRecommend < 0 || *playlistRecommend > 100 {
+			fmt.Printf("--recommend must be between 0 and 100, got %d\n", *playlistRecommend)
+			os.Exit(1)
+		}
+		if len(splitList(*playlistRecGenres)) > 4 {
+			fmt.Println("--recommend-genres takes at most 4 genres, leaving a seed for a top track")
+			os.Exit(1)
+		}
+		if *playlistMinEnergy < 0 || *playlistMinEnergy > 1 || *playlistMinDance < 0 || *playlistMinDance > 1 {
+			fmt.Println("--min-energy and --min-danceability must be between 0 and 1")
+			os.Exit(1)
+		}
+		if *playlistWatch {
+			if *playlistInterval <= 0 {
+				fmt.Printf("--interval must be positive, got %v\n", *playlistInterval)
+				os.Exit(1)
+			}
+			// Nobody is around to answer the prompt between runs.
+			if *playlistSinceSnapshot {
+				fmt.Println("--since_snapshot can't be used with --watch")
+				os.Exit(1)
+			}
+		}
+		if !sortOrders[*playlistSort] {
+			fmt.Printf("unknown --sort %q, want rank, popularity, release, or name\n", *playlistSort)
+			os.Exit(1)
+		}
+		if *playlistSortFinal != "" && !validSortKeys[*playlistSortFinal] {
+			fmt.Printf("unknown --sort_final %q, want popularity, release_date, duration, or tempo\n", *playlistSortFinal)
+			os.Exit(1)
+		}
+		if *playlistList == true {
+			if *playlistFormat != "text" && *playlistFormat != "json" {
+				fmt.Fprintf(os.Stderr, "unknown --format %q, want text or json\n", *playlistFormat)
+				os.Exit(1)
+			}
+			if *playlistCollabOnly && *playlistNonCollab {
+				fmt.Fprintln(os.Stderr, "--collaborative_only and --non_collaborative can't be used together")
+				os.Exit(1)
+			}
+			slog.Info("listing playlists", "user", redact(user.ID))
+			allUsersPlaylists, err := allCurrentPlaylists(ctx, client)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "unable to get user playlists: %v\n", err)
+				os.Exit(1)
+			}
+			type jsonPlaylist struct {
+				Name       string     `json:"name"`
+				ID         spotify.ID `json:"id"`
+				Owner      string     `json:"owner"`
+				TrackCount int        `json:"trackCount"`
+				Public     bool       `json:"public"`
+				TopArtists []string   `json:"topArtists,omitempty"`
+			}
+			listed := []jsonPlaylist{}
+			for _, v := range allUsersPlaylists {
+				if *playlistOwnedOnly && v.Owner.ID != user.ID {
+					continue
+				}
+				if (*playlistCollabOnly && !v.Collaborative) || (*playlistNonCollab && v.Collaborative) {
+					continue
+				}
+				var artists []string
+				if *playlistVerbose && set.dated.MatchString(v.Name) {
+					artists, err = previewArtists(ctx, client, v.ID, previewArtistCount)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "previewArtists(ctx,client,%v): %v\n", redact(string(v.ID)), err)
+						os.Exit(1)
+					}
+					for i := range artists {
+						artists[i] = redact(artists[i])
+					}
+				}
+				if *playlistFormat == "json" {
+					listed = append(listed, jsonPlaylist{v.Name, spotify.ID(redact(string(v.ID))), redact(v.Owner.ID), int(v.Tracks.Total), v.IsPublic, artists})
+					continue
+				}
+				if !*playlistVerbose {
+					fmt.Printf("name: %v\tid: %v\tcollaborative: %v\n", v.Name, redact(string(v.ID)), v.Collaborative)
+					continue
+				}
+				fmt.Printf("name: %v\tid: %v\tcollaborative: %v\ttracks: %d\towner: %v\n", v.Name, redact(string(v.ID)), v.Collaborative, v.Tracks.Total, redact(v.Owner.ID))
+				if len(artists) > 0 {
+					fmt.Printf("\ttop artists: %v\n", strings.Join(artists, ", "))
+				}
+			}
+			if *playlistFormat == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(listed); err != nil {
+					fmt.Fprintf(os.Stderr, "json.Encode(): %v\n", err)
+					os.Exit(1)
+				}
+			}
+		}
+		if *playlistExport != "" {
+			format := *playlistFormat
+			if !flagSet(playlistCmd, "format") {
+				format = "csv"
+			}
+			if format != "csv" && format != "json" {
+				fmt.Printf("unknown --format %q for --export, want csv or json\n", format)
+				os.Exit(1)
+			}
+			pl, err := resolvePlaylist(ctx, client, user, *playlistExport)
+			if err != nil {
+				fmt.Printf("resolvePlaylist(%v): %v\n", *playlistExport, err)
+				os.Exit(1)
+			}
+			items, err := getAllPlaylistItems(ctx, client, pl.ID, playlistItemTypes(true))
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			out := *playlistOut
+			if out == "" {
+				// Playlist names can contain path separators.
+				out = strings.NewReplacer("/", "_", "\\", "_").Replace(pl.Name) + "." + format
+			}
+			f, err := os.Create(out)
+			if err != nil {
+				fmt.Printf("os.Create(%v): %v\n", out, err)
+				os.Exit(1)
+			}
+			rows := exportRows(items)
+			err = writeExport(f, rows, format)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				fmt.Printf("writeExport(%v): %v\n", out, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Wrote %d items from %v to %v\n", len(rows), pl.Name, out)
+		}
+		if *playlistImport != "" {
+			if *playlistName == "" {
+				fmt.Println("--name is required with --import")
+				os.Exit(1)
+			}
+			added, unresolved, err := importPlaylist(ctx, client, user, *playlistImport, *playlistName, description)
+			if err != nil {
+				fmt.Printf("importPlaylist(%v): %v\n", *playlistImport, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Imported %d tracks into %v (%d rows couldn't be resolved)\n", added, *playlistName, unresolved)
+		}
+		if *playlistDelete {
+			allUsersPlaylists, err := allCurrentPlaylists(ctx, client)
+			if err != nil {
+				fmt.Printf("unable to get user playlists: %v\n", err)
+				os.Exit(1)
+			}
+			// Spotify can't delete playlists: unfollowing one you own removes it from your
+			// library, which is as close as it gets.
+			var matched []spotify.SimplePlaylist
+			for _, v := range allUsersPlaylists {
+				if set.dated.MatchString(v.Name) {
+					matched = append(matched, v)
+				}
+			}
+			if len(matched) == 0 {
+				fmt.Println("No automated playlists to delete")
+				break
+			}
+			for _, v := range matched {
+				fmt.Printf("name: %v\tid: %v\ttracks: %d\n", v.Name, redact(string(v.ID)), v.Tracks.Total)
+			}
+			if !*playlistConfirm && !confirm(fmt.Sprintf("Delete these %d playlists?", len(matched))) {
+				fmt.Println("Nothing deleted")
+				break
+			}
+			for _, v := range matched {
+				if err := client.UnfollowPlaylist(ctx, v.ID); err != nil {
+					fmt.Printf("UnfollowPlaylist(ctx,%v): %v\n", redact(string(v.ID)), err)
+					os.Exit(1)
+				}
+				fmt.Printf("deleted %v\n", v.Name)
+			}
+			break
+		}
+		// The playlists that couldn't be purged. The others are still purged, but the
+		// command exits non-zero once the summary is printed.
+		var purgeFailed []string
+		if *playlistPurgeFavTracks == true {
+			var cutoff time2.Time
+			if *playlistOlderThan < 0 {
+				fmt.Printf("--older-than must not be negative, got %v\n", *playlistOlderThan)
+				os.Exit(1)
+			} else if *playlistOlderThan > 0 {
+				cutoff = time2.Now().Add(-*playlistOlderThan)
+			}
+			slog.Info("purging tracks from the automated playlists")
+			allUsersPlaylists, err := allCurrentPlaylists(ctx, client)
+			if err != nil {
+				fmt.Printf("unable to get user playlists: %v\n", err)
+				os.Exit(1)
+			}
+			automatedPlaylists, err := getAutomatedPlaylists(ctx, client, user, set, allUsersPlaylists, description, *playlistDryRun)
+			if err != nil {
+				fmt.Printf("getAutomatedPlaylists(ctx,client,%v): %v\n", redact(user.ID), err)
+				os.Exit(1)
+			}
+			automatedPlaylists = append(automatedPlaylists, datedPlaylists(set, allUsersPlaylists)...)
+			for _, v := range automatedPlaylists {
+				// A dry run's placeholder for a missing playlist has nothing to purge.
+				if v.ID == "" {
+					continue
+				}
+				slog.Info("purging tracks on playlist", "playlist", v.Name)
+				// A dry run always takes the item-based path so it can list what it would
+				// remove, and so does --older-than, which keeps some items.
+				if *playlistFastPurge && !*playlistDryRun && *playlistOlderThan == 0 {
+					if err = clearPlaylist(ctx, client, v.ID, *playlistRetries); err == nil {
+						report.add(v.Name, func(rc *playlistCounts) { rc.Removed += int(v.Tracks.Total) })
+					}
+				} else {
+					err = purgeTracks(ctx, client, v, *playlistEpisodes, cutoff, *playlistRetries, *playlistDryRun)
+				}
+				if err != nil {
+					slog.Error("purgeTracks() failed", "playlist", v.Name, "err", err)
+					report.fail(v.Name, err)
+					purgeFailed = append(purgeFailed, v.Name)
+				}
+			}
+		}
+		if *playlistSetVisibility {
+			allUsersPlaylists, err := allCurrentPlaylists(ctx, client)
+			if err != nil {
+				fmt.Printf("unable to get user playlists: %v\n", err)
+				os.Exit(1)
+			}
+			automatedPlaylists, err := getAutomatedPlaylists(ctx, client, user, set, allUsersPlaylists, description, false)
+			if err != nil {
+				fmt.Printf("getAutomatedPlaylists(ctx,client,%v): %v\n", redact(user.ID), err)
+				os.Exit(1)
+			}
+			if *playlistCollaborative {
+				slog.Warn("the Spotify client can't make existing playlists collaborative, only changing whether they're public")
+			}
+			visibility := "private"
+			if *playlistPublic {
+				visibility = "public"
+			}
+			for _, v := range automatedPlaylists {
+				if v.IsPublic == *playlistPublic {
+					continue
+				}
+				if err := client.ChangePlaylistAccess(ctx, v.ID, *playlistPublic); err != nil {
+					fmt.Printf("ChangePlaylistAccess(ctx,%v,%v): %v\n", redact(string(v.ID)), *playlistPublic, err)
+					os.Exit(1)
+				}
+				fmt.Printf("made %v %v\n", v.Name, visibility)
+			}
+		}
+		if *playlistPurgeDupes {
+			slog.Info("removing duplicate tracks from the automated playlists")
+			allUsersPlaylists, err := allCurrentPlaylists(ctx, client)
+			if err != nil {
+				fmt.Printf("unable to get user playlists: %v\n", err)
+				os.Exit(1)
+			}
+			automatedPlaylists, err := getAutomatedPlaylists(ctx, client, user, set, allUsersPlaylists, description, *playlistDryRun)
+			if err != nil {
+				fmt.Printf("getAutomatedPlaylists(ctx,client,%v): %v\n", redact(user.ID), err)
+				os.Exit(1)
+			}
+			automatedPlaylists = append(automatedPlaylists, datedPlaylists(set, allUsersPlaylists)...)
+			for _, v := range automatedPlaylists {
+				if v.ID == "" {
+					continue
+				}
+				n, err := purgeDuplicates(ctx, client, v, *playlistRetries, *playlistDryRun)
+				if err != nil {
+					slog.Error("purgeDuplicates() failed", "playlist", v.Name, "err", err)
+					report.fail(v.Name, err)
+					purgeFailed = append(purgeFailed, v.Name)
+					continue
+				}
+				if *playlistDryRun {
+					fmt.Fprintf(textOut(), "dry run: would remove %d duplicates from %v\n", n, v.Name)
+					continue
+				}
+				fmt.Fprintf(textOut(), "removed %d duplicates from %v\n", n, v.Name)
+				report.add(v.Name, func(rc *playlistCounts) { rc.Removed += n })
+			}
+		}
+		// TODO(dduclayan): Refactor to google style guide
+		var fillErr error
+		if *playlistFill == true {
+			if *playlistWatch {
+				watchFill(root, client, user, set, description, limit, filter)
+			} else {
+				_, fillErr = runFill(ctx, client, user, set, description, limit, seed, filter, start)
+			}
+		}
+		// The summary covers whatever was done, so it's printed even if the fill failed.
+		if !*playlistQuiet || *playlistFormat == "json" {
+			if err := report.write(os.Stdout, *playlistFormat); err != nil {
+				slog.Warn("couldn't write the summary", "err", err)
+			}
+		}
+		if len(purgeFailed) > 0 {
+			fmt.Fprintf(textOut(), "couldn't purge %v\n", strings.Join(purgeFailed, ", "))
+		}
+		if fillErr != nil {
+			fmt.Fprintln(textOut(), fillErr)
+		}
+		if len(purgeFailed) > 0 || fillErr != nil {
+			os.Exit(1)
+		}
+	case "refresh":
+		if err := refreshCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse refresh flags")
+			os.Exit(1)
+		}
+		if *refreshThreshold < 0 || *refreshThreshold > 1 {
+			fmt.Printf("--threshold must be between 0 and 1, got %v\n", *refreshThreshold)
+			os.Exit(1)
+		}
+		allUsersPlaylists, err := allCurrentPlaylists(ctx, client)
+		if err != nil {
+			fmt.Printf("unable to get user playlists: %v\n", err)
+			os.Exit(1)
+		}
+		automatedPlaylists, err := getAutomatedPlaylists(ctx, client, user, trackPlaylists, allUsersPlaylists, defaultDescription, false)
+		if err != nil {
+			fmt.Printf("getAutomatedPlaylists(ctx,client,%v): %v\n", redact(user.ID), err)
+			os.Exit(1)
+		}
+		for _, cfg := range termConfigs(user, trackPlaylists, automatedPlaylists) {
+			refreshed, staleness, err := refreshIfStale(ctx, client, cfg, *refreshThreshold)
+			if err != nil {
+				fmt.Printf("refreshIfStale(ctx,client,%v): %v\n", cfg.name, err)
+				os.Exit(1)
+			}
+			if refreshed {
+				fmt.Printf("refreshed %v (staleness %.2f)\n", cfg.name, staleness)
+			} else {
+				fmt.Printf("skipped %v, still fresh (staleness %.2f)\n", cfg.name, staleness)
+			}
+		}
+	case "unfollow":
+		if err := unfollowCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse unfollow flags")
+			os.Exit(1)
+		}
+		if *unfollowPattern == "" {
+			fmt.Println("--pattern is required")
+			os.Exit(1)
+		}
+		re, err := regexp.Compile(*unfollowPattern)
+		if err != nil {
+			fmt.Printf("invalid --pattern: %v\n", err)
+			os.Exit(1)
+		}
+		playlists, err := allCurrentPlaylists(ctx, client)
+		if err != nil {
+			fmt.Printf("unable to get user playlists: %v\n", err)
+			os.Exit(1)
+		}
+		var matched []spotify.SimplePlaylist
+		for _, v := range playlists {
+			if re.MatchString(v.Name) {
+				matched = append(matched, v)
+			}
+		}
+		if len(matched) == 0 {
+			fmt.Printf("No playlists match %q\n", *unfollowPattern)
+			break
+		}
+		for _, v := range matched {
+			if v.Owner.ID == user.ID {
+				fmt.Printf("name: %v\tid: %v\t(yours, it will be removed from your library)\n", v.Name, redact(string(v.ID)))
+			} else {
+				fmt.Printf("name: %v\tid: %v\t(owned by %v, you'll only stop following it)\n", v.Name, redact(string(v.ID)), redact(v.Owner.ID))
+			}
+		}
+		if !*unfollowYes && !confirm(fmt.Sprintf("Unfollow these %d playlists?", len(matched))) {
+			fmt.Println("Nothing unfollowed")
+			break
+		}
+		for _, v := range matched {
+			if err := client.UnfollowPlaylist(ctx, v.ID); err != nil {
+				fmt.Printf("UnfollowPlaylist(ctx,%v): %v\n", redact(string(v.ID)), err)
+				os.Exit(1)
+			}
+			fmt.Printf("unfollowed %v\n", v.Name)
+		}
+	case "fill_search":
+		if err := fillSearchCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse fill_search flags")
+			os.Exit(1)
+		}
+		if strings.TrimSpace(*fillSearchQuery) == "" {
+			fmt.Println("--query is required")
+			os.Exit(1)
+		}
+		if *fillSearchPlaylist == "" {
+			fmt.Println("--playlist is required")
+			os.Exit(1)
+		}
+		if *fillSearchCount < 1 {
+			fmt.Printf("--count must be positive, got %d\n", *fillSearchCount)
+			os.Exit(1)
+		}
+		filter := trackFilter{
+			minPopularity: *fillSearchPopularity,
+			explicit:      *fillSearchExplicit,
+			minDuration:   time2.Duration(*fillSearchMinDuration) * time2.Second,
+			maxDuration:   time2.Duration(*fillSearchMaxDuration) * time2.Second,
+		}
+		if err := filter.validate(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		market := *fillSearchMarket
+		if market == "" {
+			market = user.Country
+		}
+		tracks, err := searchTracks(ctx, client, *fillSearchQuery, *fillSearchCount, market, filter)
+		if err != nil {
+			fmt.Printf("searchTracks(): %v\n", err)
+			os.Exit(1)
+		}
+		if len(tracks.Tracks) == 0 {
+			fmt.Printf("No tracks match %q\n", *fillSearchQuery)
+			break
+		}
+		playlistID, err := findOrCreatePlaylist(ctx, client, user, *fillSearchPlaylist)
+		if err != nil {
+			fmt.Printf("findOrCreatePlaylist(ctx,client,%v): %v\n", *fillSearchPlaylist, err)
+			os.Exit(1)
+		}
+		skip, err := existingTrackIDs(ctx, client, playlistID)
+		if err != nil {
+			fmt.Printf("existingTrackIDs(ctx,client,%v): %v\n", redact(string(playlistID)), err)
+			os.Exit(1)
+		}
+		res, err := fillPlaylist(ctx, client, playlistID, *fillSearchPlaylist, tracks, skip, -1, false)
+		if err != nil {
+			fmt.Printf("fillPlaylist(): %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Added %d tracks to %v (%d already there)\n", res.added, *fillSearchPlaylist, res.skipped)
+	case "genres":
+		if err := genresCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse genres flags")
+			os.Exit(1)
+		}
+		term, err := termRange(*genresTerm)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if *genresTop < 1 {
+			fmt.Printf("--top must be positive, got %d\n", *genresTop)
+			os.Exit(1)
+		}
+		genres, err := topGenres(ctx, client, term)
+		if err != nil {
+			fmt.Printf("topGenres(): %v\n", err)
+			os.Exit(1)
+		}
+		if len(genres) == 0 {
+			fmt.Println("Spotify has no genres for your top artists")
+			break
+		}
+		if len(genres) > *genresTop {
+			genres = genres[:*genresTop]
+		}
+		for i, g := range genres {
+			fmt.Printf("%3d. %v\tscore: %d\tartists: %d\n", i+1, g.genre, g.score, g.artists)
+		}
+	case "duplicates":
+		if err := duplicatesCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse duplicates flags")
+			os.Exit(1)
+		}
+		playlists, err := allCurrentPlaylists(ctx, client)
+		if err != nil {
+			fmt.Printf("unable to get user playlists: %v\n", err)
+			os.Exit(1)
+		}
+		groups := duplicateNames(playlists)
+		if len(groups) == 0 {
+			fmt.Println("No playlists share a name")
+			break
+		}
+		for _, group := range groups {
+			fmt.Printf("%q:\n", group[0].Name)
+			for i, v := range group {
+				fmt.Printf("  %d. id: %v\ttracks: %d\towner: %v\n", i+1, redact(string(v.ID)), v.Tracks.Total, redact(v.Owner.ID))
+			}
+			if !*duplicatesResolve {
+				continue
+			}
+			keep := choose("Keep which one? The others will be unfollowed", len(group))
+			if keep == 0 {
+				fmt.Println("  skipped")
+				continue
+			}
+			for i, v := range group {
+				if i+1 == keep {
+					continue
+				}
+				if err := client.UnfollowPlaylist(ctx, v.ID); err != nil {
+					fmt.Printf("UnfollowPlaylist(ctx,%v): %v\n", redact(string(v.ID)), err)
+					os.Exit(1)
+				}
+				fmt.Printf("  unfollowed %v\n", redact(string(v.ID)))
+			}
+		}
+		if !*duplicatesResolve {
+			fmt.Printf("%d names are shared by more than one playlist, rerun with --resolve to pick which to keep\n", len(groups))
+		}
+	case "export_m3u":
+		if err := exportM3UCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse export_m3u flags")
+			os.Exit(1)
+		}
+		term, err := termRange(*exportM3UTerm)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		config := playlistConfig{duration: term}
+		tracks, err := config.getTopTracks(ctx, client)
+		if err != nil {
+			fmt.Printf("getTopTracks(): %v\n", err)
+			os.Exit(1)
+		}
+		f, err := os.Create(*exportM3UOut)
+		if err != nil {
+			fmt.Printf("os.Create(%v): %v\n", *exportM3UOut, err)
+			os.Exit(1)
+		}
+		var page []spotify.FullTrack
+		if tracks != nil {
+			page = tracks.Tracks
+		}
+		err = writeM3U(f, page, *exportM3UURI)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Printf("writeM3U(%v): %v\n", *exportM3UOut, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %d tracks to %v\n", len(page), *exportM3UOut)
+	case "top":
+		if err := topCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse top flags")
+			os.Exit(1)
+		}
+		if *topConcurrency < 1 {
+			fmt.Println("--concurrency must be at least 1")
+			os.Exit(1)
+		}
+		if err := printTopTracks(ctx, client, *topTerm, *topParallel, *topConcurrency); err != nil {
+			fmt.Printf("printTopTracks(ctx,client,%v): %v\n", *topTerm, err)
+			os.Exit(1)
+		}
+	case "compare":
+		if err := compareCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse compare flags")
+			os.Exit(1)
+		}
+		id, err := parsePlaylistID(*comparePlaylist)
+		if err != nil {
+			fmt.Printf("parsePlaylistID(%v): %v\n", *comparePlaylist, err)
+			os.Exit(1)
+		}
+		term, err := termRange(*compareTerm)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := compareWithPlaylist(ctx, client, id, term); err != nil {
+			fmt.Printf("compareWithPlaylist(ctx,client,%v,%v): %v\n", redact(string(id)), term, err)
+			os.Exit(1)
+		}
+	case "items":
+		if err := itemsCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse items flags")
+			os.Exit(1)
+		}
+		id, err := parsePlaylistID(*itemsPlaylist)
+		if err != nil {
+			fmt.Printf("parsePlaylistID(%v): %v\n", *itemsPlaylist, err)
+			os.Exit(1)
+		}
+		filter := trackFilter{minPopularity: *itemsMinPopularity, artist: *itemsByArtist, explicit: *itemsExplicit}
+		if err := filter.validate(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if *itemsFormat != "text" && *itemsFormat != "json" {
+			fmt.Printf("unknown --format %q, want text or json\n", *itemsFormat)
+			os.Exit(1)
+		}
+		if err := printPlaylistItems(ctx, client, id, filter, *itemsFormat); err != nil {
+			fmt.Printf("printPlaylistItems(ctx,client,%v): %v\n", redact(string(id)), err)
+			os.Exit(1)
+		}
+	case "last_updated":
+		if err := lastUpdatedCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse last_updated flags")
+			os.Exit(1)
+		}
+		allUsersPlaylists, err := allCurrentPlaylists(ctx, client)
+		if err != nil {
+			fmt.Printf("unable to get user playlists: %v\n", err)
+			os.Exit(1)
+		}
+		for _, v := range allUsersPlaylists {
+			if !trackPlaylists.dated.MatchString(v.Name) {
+				continue
+			}
+			latest, err := lastAddedAt(ctx, client, v.ID)
+			if err != nil {
+				fmt.Printf("lastAddedAt(ctx,client,%v): %v\n", redact(string(v.ID)), err)
+				os.Exit(1)
+			}
+			if latest.IsZero() {
+				fmt.Printf("%v: never\n", v.Name)
+				continue
+			}
+			fmt.Printf("%v: %v\n", v.Name, latest.Local().Format(time2.RFC1123))
+		}
+	case "workout":
+		if err := workoutCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse workout flags")
+			os.Exit(1)
+		}
+		term, err := termRange(*workoutTerm)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if *workoutLimit < 1 || *workoutLimit > 100 {
+			fmt.Printf("--limit must be between 1 and 100, got %d\n", *workoutLimit)
+			os.Exit(1)
+		}
+		targets := audioTargets{
+			energy:       *workoutEnergy,
+			danceability: *workoutDanceability,
+			valence:      *workoutValence,
+			tempo:        *workoutTempo,
+		}
+		if err := targets.validate(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		ids, err := recommendForTargets(ctx, client, term, targets, *workoutLimit)
+		if err != nil {
+			fmt.Printf("recommendForTargets(): %v\n", err)
+			os.Exit(1)
+		}
+		playlistID, err := findOrCreatePlaylist(ctx, client, user, *workoutName)
+		if err != nil {
+			fmt.Printf("findOrCreatePlaylist(ctx,client,%v): %v\n", *workoutName, err)
+			os.Exit(1)
+		}
+		if err := replacePlaylistTracks(ctx, client, playlistID, ids); err != nil {
+			fmt.Printf("replacePlaylistTracks(): %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Rebuilt %v with %d recommended tracks\n", *workoutName, len(ids))
+	case "archive":
+		if err := archiveCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse archive flags")
+			os.Exit(1)
+		}
+		term, err := termRange(*archiveTerm)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if *archiveTo == "" {
+			fmt.Println("--to is required")
+			os.Exit(1)
+		}
+		// Archives are always created fresh and never refilled, so they aren't looked up
+		// like the automated playlists.
+		config := playlistConfig{
+			name:        *archiveTo,
+			description: fmt.Sprintf("Top %v term tracks, archived %v by top_tracks_cli", *archiveTerm, time2.Now().Format(time2.DateOnly)),
+			duration:    term,
+			user:        user,
+		}
+		tracks, err := config.getTopTracks(ctx, client)
+		if err != nil {
+			fmt.Printf("getTopTracks(): %v\n", err)
+			os.Exit(1)
+		}
+		if tracks == nil || len(tracks.Tracks) == 0 {
+			fmt.Println("No top tracks to archive")
+			os.Exit(1)
+		}
+		if _, err := config.createPlaylist(ctx, client, tracks.Tracks); err != nil {
+			fmt.Printf("createPlaylist(ctx,client,%v): %v\n", config.name, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Archived %d tracks to %v\n", len(tracks.Tracks), config.name)
+	case "custom":
+		if err := customCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse custom flags")
+			os.Exit(1)
+		}
+		term, err := termRange(*customTermRange)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if strings.TrimSpace(*customPlaylistName) == "" {
+			fmt.Println("--playlist-name is required")
+			os.Exit(1)
+		}
+		limitFlag, n := "--limit", *customLimit
+		if flagSet(customCmd, "count") {
+			if flagSet(customCmd, "limit") {
+				fmt.Println("--count and --limit can't be used together")
+				os.Exit(1)
+			}
+			limitFlag, n = "--count", *customCount
+		}
+		limit, err := validateLimit(limitFlag, n, false)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		allUsersPlaylists, err := allCurrentPlaylists(ctx, client)
+		if err != nil {
+			fmt.Printf("unable to get user playlists: %v\n", err)
+			os.Exit(1)
+		}
+		set := namedSet(*customPlaylistName, term)
+		description := fmt.Sprintf("Top %v term tracks, filled by top_tracks_cli", *customTermRange)
+		found, err := getAutomatedPlaylists(ctx, client, user, set, allUsersPlaylists, description, false)
+		if err != nil {
+			fmt.Printf("getAutomatedPlaylists(ctx,client,%v): %v\n", redact(user.ID), err)
+			os.Exit(1)
+		}
+		config := termConfigs(user, set, found)[0]
+		config.limit = limit
+		config.retries = -1
+		res, err := getTopTracksAndFill(ctx, client, config)
+		if err != nil {
+			fmt.Printf("getTopTracksAndFill(ctx,client,%v): %v\n", config.name, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Added %d tracks to %v (%d already there)\n", res.added, config.name, res.skipped)
+	case "audit":
+		if err := auditCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse audit flags")
+			os.Exit(1)
+		}
+		id, err := parsePlaylistID(*auditPlaylist)
+		if err != nil {
+			fmt.Printf("parsePlaylistID(%v): %v\n", *auditPlaylist, err)
+			os.Exit(1)
+		}
+		dead, err := unplayableTracks(ctx, client, id, user.Country)
+		if err != nil {
+			fmt.Printf("unplayableTracks(ctx,client,%v): %v\n", redact(string(id)), err)
+			os.Exit(1)
+		}
+		if len(dead) == 0 {
+			fmt.Println("All tracks are playable")
+			break
+		}
+		for _, d := range dead {
+			fmt.Printf("%4d. %v: %v\n", d.position+1, redact(d.name), d.reason)
+		}
+		if !*auditRemove {
+			fmt.Printf("%d unplayable tracks, rerun with --remove to drop them\n", len(dead))
+			break
+		}
+		removed, err := removeDeadTracks(ctx, client, id, dead)
+		if err != nil {
+			fmt.Printf("removeDeadTracks(ctx,client,%v): %v\n", redact(string(id)), err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed %d of %d unplayable tracks\n", removed, len(dead))
+	case "like_top":
+		if err := likeTopCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse like_top flags")
+			os.Exit(1)
+		}
+		term, err := termRange(*likeTopTerm)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		config := playlistConfig{duration: term}
+		tracks, err := config.getTopTracks(ctx, client)
+		if err != nil {
+			fmt.Printf("getTopTracks(): %v\n", err)
+			os.Exit(1)
+		}
+		if tracks == nil {
+			fmt.Println("No top tracks to like")
+			break
+		}
+		liked, err := likeTracks(ctx, client, tracks.Tracks)
+		if err != nil {
+			fmt.Printf("likeTracks(): %v (%d liked before the error)\n", err, liked)
+			os.Exit(1)
+		}
+		fmt.Printf("Liked %d new tracks, %d were already liked\n", liked, len(tracks.Tracks)-liked)
+	case "split":
+		if err := splitCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse split flags")
+			os.Exit(1)
+		}
+		id, err := parsePlaylistID(*splitPlaylist)
+		if err != nil {
+			fmt.Printf("parsePlaylistID(%v): %v\n", *splitPlaylist, err)
+			os.Exit(1)
+		}
+		if *splitSize < 1 {
+			fmt.Printf("--size must be positive, got %d\n", *splitSize)
+			os.Exit(1)
+		}
+		items, err := getAllPlaylistItems(ctx, client, id, playlistItemTypes(false))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		var tracks []spotify.FullTrack
+		for _, v := range items {
+			if itemKind(v) == "track" {
+				tracks = append(tracks, *v.Track.Track)
+			}
+		}
+		if len(tracks) == 0 {
+			fmt.Println("The playlist has no tracks to split")
+			os.Exit(1)
+		}
+		for i := 0; i < len(tracks); i += *splitSize {
+			end := i + *splitSize
+			if end > len(tracks) {
+				end = len(tracks)
+			}
+			config := playlistConfig{
+				name:        fmt.Sprintf("%v %d", *splitPrefix, i/(*splitSize)+1),
+				description: defaultDescription,
+				user:        user,
+			}
+			pl, err := config.createPlaylist(ctx, client, tracks[i:end])
+			if err != nil {
+				fmt.Printf("createPlaylist(ctx,client,%v): %v\n", config.name, err)
+				os.Exit(1)
+			}
+			fmt.Printf("%v (%d tracks): %v\n", config.name, end-i, pl.ExternalURLs["spotify"])
+		}
+	case "show_queue":
+		if err := showQueueCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse show_queue flags")
+			os.Exit(1)
+		}
+		queue, err := client.GetQueue(ctx)
+		if err != nil {
+			fmt.Printf("GetQueue(ctx): %v\n", err)
+			os.Exit(1)
+		}
+		// Without an active playback session Spotify returns no content or nothing playing.
+		if queue == nil || queue.CurrentlyPlaying.ID == "" {
+			fmt.Println("Nothing is playing. Start playback on a device to see its queue.")
+			break
+		}
+		fmt.Printf("Now playing: %v\n", redact(trackName(queue.CurrentlyPlaying)))
+		if len(queue.Items) == 0 {
+			fmt.Println("The queue is empty")
+			break
+		}
+		fmt.Println("Up next:")
+		for i, t := range queue.Items {
+			fmt.Printf("%3d. %v\n", i+1, redact(trackName(t)))
+		}
+	case "recent_adds":
+		if err := recentAddsCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse recent_adds flags")
+			os.Exit(1)
+		}
+		if *recentAddsSince <= 0 {
+			fmt.Printf("--since must be positive, got %v\n", *recentAddsSince)
+			os.Exit(1)
+		}
+		adds, err := recentAdds(ctx, client, user, time2.Now().Add(-*recentAddsSince))
+		if err != nil {
+			fmt.Printf("recentAdds(ctx,client,%v): %v\n", redact(user.ID), err)
+			os.Exit(1)
+		}
+		if len(adds) == 0 {
+			fmt.Printf("No tracks added in the last %v\n", *recentAddsSince)
+		}
+		for _, v := range adds {
+			fmt.Printf("%v\t%v\t(%v)\n", v.addedAt.Local().Format(time2.DateTime), redact(v.track), v.playlist)
+		}
+	case "follow":
+		if err := followCmd.Parse(flag.Args()[1:]); err != nil {
+			fmt.Println("couldn't parse follow flags")
+			os.Exit(1)
+		}
+		id, err := parsePlaylistID(*followPlaylist)
+		if err != nil {
+			fmt.Printf("parsePlaylistID(%v): %v\n", *followPlaylist, err)
+			os.Exit(1)
+		}
+		if err := client.FollowPlaylist(ctx, id, *followPublic); err != nil {
+			fmt.Printf("FollowPlaylist(ctx,%v,%v): %v\n", redact(string(id)), *followPublic, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Followed playlist %v\n", redact(string(id)))
+	}
+	if *showLimits {
+		limited, longest := pacer.limits()
+		fmt.Printf("Rate limited %d times, longest Retry-After %v\n", limited, longest)
+	}
+	if *profilePhases {
+		phases.each(func(name string, d time2.Duration) {
+			fmt.Printf("%-18v %v\n", name+":", d.Truncate(time2.Millisecond))
+		})
 	}
-	fmt.Printf("Done! Completed in %v\n", time2.Since(start).Truncate(time2.Millisecond))
+	slog.Info("done", "elapsed", time2.Since(start).Truncate(time2.Millisecond))
 }
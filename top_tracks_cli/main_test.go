@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/zmb3/spotify/v2"
+)
+
+// fakeSpotify is a spotifyAPI holding playlists in memory and recording the changes
+// made to them.
+type fakeSpotify struct {
+	playlists []spotify.SimplePlaylist
+	items     map[spotify.ID][]spotify.PlaylistItem
+
+	// created are the names of the playlists created, in order.
+	created []string
+	// added, removed, and removedAt are the tracks added to and removed from each
+	// playlist, by ID and by URI and position.
+	added     map[spotify.ID][]spotify.ID
+	removed   map[spotify.ID][]spotify.ID
+	removedAt map[spotify.ID][]spotify.TrackToRemove
+}
+
+func newFakeSpotify(playlists ...spotify.SimplePlaylist) *fakeSpotify {
+	return &fakeSpotify{
+		playlists: playlists,
+		items:     make(map[spotify.ID][]spotify.PlaylistItem),
+		added:     make(map[spotify.ID][]spotify.ID),
+		removed:   make(map[spotify.ID][]spotify.ID),
+		removedAt: make(map[spotify.ID][]spotify.TrackToRemove),
+	}
+}
+
+var errNotFaked = errors.New("not faked")
+
+func (f *fakeSpotify) CurrentUsersTopTracks(ctx context.Context, opts ...spotify.RequestOption) (*spotify.FullTrackPage, error) {
+	return nil, errNotFaked
+}
+
+func (f *fakeSpotify) CurrentUsersTopArtists(ctx context.Context, opts ...spotify.RequestOption) (*spotify.FullArtistPage, error) {
+	return nil, errNotFaked
+}
+
+func (f *fakeSpotify) GetArtistsTopTracks(ctx context.Context, artistID spotify.ID, country string) ([]spotify.FullTrack, error) {
+	return nil, errNotFaked
+}
+
+// CurrentUsersPlaylists returns every playlist on one page. The options, which hold an
+// unexported type, are ignored.
+func (f *fakeSpotify) CurrentUsersPlaylists(ctx context.Context, opts ...spotify.RequestOption) (*spotify.SimplePlaylistPage, error) {
+	page := &spotify.SimplePlaylistPage{Playlists: f.playlists}
+	page.Total = spotify.Numeric(len(f.playlists))
+	return page, nil
+}
+
+func (f *fakeSpotify) CreatePlaylistForUser(ctx context.Context, userID, playlistName, description string, public bool, collaborative bool) (*spotify.FullPlaylist, error) {
+	f.created = append(f.created, playlistName)
+	pl := spotify.SimplePlaylist{
+		ID:            spotify.ID("created" + string(rune('0'+len(f.created)))),
+		Name:          playlistName,
+		Description:   description,
+		IsPublic:      public,
+		Collaborative: collaborative,
+		Owner:         spotify.User{ID: userID},
+	}
+	f.playlists = append(f.playlists, pl)
+	return &spotify.FullPlaylist{SimplePlaylist: pl}, nil
+}
+
+func (f *fakeSpotify) AddTracksToPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	f.added[playlistID] = append(f.added[playlistID], trackIDs...)
+	return "snapshot", nil
+}
+
+// GetPlaylistItems returns every item on one page, like CurrentUsersPlaylists.
+func (f *fakeSpotify) GetPlaylistItems(ctx context.Context, playlistID spotify.ID, opts ...spotify.RequestOption) (*spotify.PlaylistItemPage, error) {
+	page := &spotify.PlaylistItemPage{Items: f.items[playlistID]}
+	page.Total = spotify.Numeric(len(page.Items))
+	return page, nil
+}
+
+func (f *fakeSpotify) RemoveTracksFromPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	f.removed[playlistID] = append(f.removed[playlistID], trackIDs...)
+	return "snapshot", nil
+}
+
+func (f *fakeSpotify) RemoveTracksFromPlaylistOpt(ctx context.Context, playlistID spotify.ID, tracks []spotify.TrackToRemove, snapshotID string) (string, error) {
+	f.removedAt[playlistID] = append(f.removedAt[playlistID], tracks...)
+	return "snapshot", nil
+}
+
+var _ spotifyAPI = (*fakeSpotify)(nil)
+
+func testPlaylist(id, name, owner string, tracks int) spotify.SimplePlaylist {
+	pl := spotify.SimplePlaylist{ID: spotify.ID(id), Name: name, Owner: spotify.User{ID: owner}}
+	pl.Tracks.Total = spotify.Numeric(tracks)
+	return pl
+}
+
+func trackItem(id, addedAt string) spotify.PlaylistItem {
+	t := &spotify.FullTrack{}
+	t.ID = spotify.ID(id)
+	t.URI = spotify.URI("spotify:track:" + id)
+	t.Name = id
+	return spotify.PlaylistItem{AddedAt: addedAt, Track: spotify.PlaylistItemTrack{Track: t}}
+}
+
+func localItem(name string) spotify.PlaylistItem {
+	t := &spotify.FullTrack{}
+	t.URI = spotify.URI("spotify:local:::" + name + ":180")
+	t.Name = name
+	return spotify.PlaylistItem{IsLocal: true, Track: spotify.PlaylistItemTrack{Track: t}}
+}
+
+// episodeItem is an episode as Spotify returns it when episodes are requested.
+func episodeItem(id string) spotify.PlaylistItem {
+	e := &spotify.EpisodePage{ID: spotify.ID(id), URI: spotify.URI("spotify:episode:" + id), Name: id}
+	return spotify.PlaylistItem{Track: spotify.PlaylistItemTrack{Episode: e}}
+}
+
+// episodeAsTrackItem is an episode as Spotify returns it when only tracks are requested.
+func episodeAsTrackItem(id string) spotify.PlaylistItem {
+	t := &spotify.FullTrack{}
+	t.ID = spotify.ID(id)
+	t.URI = spotify.URI("spotify:episode:" + id)
+	t.Name = id
+	return spotify.PlaylistItem{Track: spotify.PlaylistItemTrack{Track: t}}
+}
+
+func playlistIDs(playlists []spotify.SimplePlaylist) []spotify.ID {
+	var ids []spotify.ID
+	for _, v := range playlists {
+		ids = append(ids, v.ID)
+	}
+	return ids
+}
+
+func TestGetAutomatedPlaylists(t *testing.T) {
+	user := &spotify.PrivateUser{User: spotify.User{ID: "me"}}
+	tests := []struct {
+		name        string
+		playlists   []spotify.SimplePlaylist
+		dryRun      bool
+		wantIDs     []spotify.ID
+		wantCreated []string
+		wantErr     bool
+	}{
+		{
+			name:        "no existing playlists",
+			wantIDs:     []spotify.ID{"created1", "created2", "created3"},
+			wantCreated: automatedPlaylistNames,
+		},
+		{
+			name: "all exist",
+			playlists: []spotify.SimplePlaylist{
+				testPlaylist("s", "Favorite Short Term Tracks", "me", 1),
+				testPlaylist("other", "Road Trip", "me", 1),
+				testPlaylist("m", "Favorite Medium Term Tracks", "me", 1),
+				testPlaylist("l", "Favorite Long Term Tracks", "me", 1),
+			},
+			wantIDs: []spotify.ID{"s", "m", "l"},
+		},
+		{
+			name: "duplicate names use the one with more tracks",
+			playlists: []spotify.SimplePlaylist{
+				testPlaylist("s1", "Favorite Short Term Tracks", "me", 3),
+				testPlaylist("s2", "Favorite Short Term Tracks", "me", 10),
+			},
+			wantIDs:     []spotify.ID{"s2", "created1", "created2"},
+			wantCreated: automatedPlaylistNames[1:],
+		},
+		{
+			name: "duplicate names prefer the user's own playlist",
+			playlists: []spotify.SimplePlaylist{
+				testPlaylist("theirs", "Favorite Short Term Tracks", "someone", 50),
+				testPlaylist("mine", "Favorite Short Term Tracks", "me", 1),
+			},
+			wantIDs:     []spotify.ID{"mine", "created1", "created2"},
+			wantCreated: automatedPlaylistNames[1:],
+		},
+		{
+			name: "duplicate names none owned by the user",
+			playlists: []spotify.SimplePlaylist{
+				testPlaylist("a", "Favorite Short Term Tracks", "someone", 1),
+				testPlaylist("b", "Favorite Short Term Tracks", "someone else", 1),
+			},
+			wantErr: true,
+		},
+		{
+			name: "followed playlist not owned by the user",
+			playlists: []spotify.SimplePlaylist{
+				testPlaylist("theirs", "Favorite Short Term Tracks", "someone", 1),
+			},
+			wantIDs:     []spotify.ID{"theirs", "created1", "created2"},
+			wantCreated: automatedPlaylistNames[1:],
+		},
+		{
+			name: "names match ignoring case and whitespace",
+			playlists: []spotify.SimplePlaylist{
+				testPlaylist("s", "favorite short term tracks", "me", 1),
+				testPlaylist("m", "  FAVORITE MEDIUM TERM TRACKS ", "me", 1),
+				testPlaylist("m2", "Favorite Medium Term Tracks", "me", 0),
+			},
+			wantIDs:     []spotify.ID{"s", "m", "created1"},
+			wantCreated: automatedPlaylistNames[2:],
+		},
+		{
+			name:    "dry run creates nothing",
+			dryRun:  true,
+			wantIDs: []spotify.ID{"", "", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeSpotify(tt.playlists...)
+			got, err := getAutomatedPlaylists(context.Background(), c, user, trackPlaylists, tt.playlists, "", tt.dryRun)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getAutomatedPlaylists() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if ids := playlistIDs(got); !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("getAutomatedPlaylists() IDs = %q, want %q", ids, tt.wantIDs)
+			}
+			if !reflect.DeepEqual(c.created, tt.wantCreated) {
+				t.Errorf("created %q, want %q", c.created, tt.wantCreated)
+			}
+		})
+	}
+}
+
+func TestPurgeTracks(t *testing.T) {
+	cutoff := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		items         []spotify.PlaylistItem
+		episodes      bool
+		cutoff        time.Time
+		wantRemoved   []spotify.ID
+		wantRemovedAt []spotify.TrackToRemove
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:        "tracks",
+			items:       []spotify.PlaylistItem{trackItem("a", "2024-01-01T00:00:00Z"), trackItem("b", "")},
+			wantRemoved: []spotify.ID{"a", "b"},
+		},
+		{
+			name:          "episodes are removed by position",
+			items:         []spotify.PlaylistItem{trackItem("a", ""), episodeItem("e")},
+			episodes:      true,
+			wantRemoved:   []spotify.ID{"a"},
+			wantRemovedAt: []spotify.TrackToRemove{{URI: "spotify:episode:e", Positions: []int{1}}},
+		},
+		{
+			name: "older than the cutoff keeps items without an added date",
+			items: []spotify.PlaylistItem{
+				trackItem("old", "2024-01-01T00:00:00Z"),
+				trackItem("undated", ""),
+				trackItem("garbled", "yesterday"),
+				trackItem("new", "2024-07-01T00:00:00Z"),
+			},
+			cutoff:        cutoff,
+			wantRemovedAt: []spotify.TrackToRemove{{URI: "spotify:track:old", Positions: []int{0}}},
+		},
+		{
+			name: "episodes and local files without --episodes",
+			items: []spotify.PlaylistItem{
+				trackItem("a", ""),
+				episodeAsTrackItem("ep1"),
+				localItem("song"),
+				{},
+			},
+			wantRemoved:   []spotify.ID{"a"},
+			wantRemovedAt: []spotify.TrackToRemove{{URI: "spotify:local:::song:180", Positions: []int{2}}},
+		},
+		{
+			name: "episodes and local files with --episodes",
+			items: []spotify.PlaylistItem{
+				episodeItem("ep1"),
+				trackItem("a", ""),
+				localItem("song"),
+				episodeAsTrackItem("ep2"),
+			},
+			episodes:    true,
+			wantRemoved: []spotify.ID{"a"},
+			wantRemovedAt: []spotify.TrackToRemove{
+				{URI: "spotify:episode:ep1", Positions: []int{0}},
+				{URI: "spotify:local:::song:180", Positions: []int{2}},
+				{URI: "spotify:episode:ep2", Positions: []int{3}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := testPlaylist("p", "Favorite Short Term Tracks", "me", len(tt.items))
+			c := newFakeSpotify(pl)
+			c.items[pl.ID] = tt.items
+			if err := purgeTracks(context.Background(), c, pl, tt.episodes, tt.cutoff, 0, false); err != nil {
+				t.Fatalf("purgeTracks() error = %v", err)
+			}
+			if got := c.removed[pl.ID]; !reflect.DeepEqual(got, tt.wantRemoved) {
+				t.Errorf("removed by ID %q, want %q", got, tt.wantRemoved)
+			}
+			if got := c.removedAt[pl.ID]; !reflect.DeepEqual(got, tt.wantRemovedAt) {
+				t.Errorf("removed by position %v, want %v", got, tt.wantRemovedAt)
+			}
+		})
+	}
+}
+
+func TestFillPlaylist(t *testing.T) {
+	tests := []struct {
+		name        string
+		tracks      []string
+		skip        []spotify.ID
+		wantAdded   []spotify.ID
+		wantSkipped int
+	}{
+		{
+			name:      "new tracks",
+			tracks:    []string{"a", "b"},
+			wantAdded: []spotify.ID{"a", "b"},
+		},
+		{
+			name:        "tracks already on the playlist",
+			tracks:      []string{"a", "b", "c"},
+			skip:        []spotify.ID{"b"},
+			wantAdded:   []spotify.ID{"a", "c"},
+			wantSkipped: 1,
+		},
+		{
+			name:        "tracks repeated on the page",
+			tracks:      []string{"a", "b", "a"},
+			wantAdded:   []spotify.ID{"a", "b"},
+			wantSkipped: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeSpotify()
+			page := &spotify.FullTrackPage{}
+			for _, id := range tt.tracks {
+				var track spotify.FullTrack
+				track.ID = spotify.ID(id)
+				page.Tracks = append(page.Tracks, track)
+			}
+			skip := make(map[spotify.ID]bool)
+			for _, id := range tt.skip {
+				skip[id] = true
+			}
+			res, err := fillPlaylist(context.Background(), c, "p", "Favorite Short Term Tracks", page, skip, 0, false)
+			if err != nil {
+				t.Fatalf("fillPlaylist() error = %v", err)
+			}
+			if got := c.added["p"]; !reflect.DeepEqual(got, tt.wantAdded) {
+				t.Errorf("added %q, want %q", got, tt.wantAdded)
+			}
+			if res.added != len(tt.wantAdded) || res.skipped != tt.wantSkipped {
+				t.Errorf("fillPlaylist() = %d added, %d skipped, want %d, %d", res.added, res.skipped, len(tt.wantAdded), tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestExistingTrackIDs(t *testing.T) {
+	c := newFakeSpotify()
+	c.items["p"] = []spotify.PlaylistItem{
+		trackItem("a", ""),
+		episodeAsTrackItem("ep1"),
+		localItem("song"),
+		{},
+		trackItem("b", ""),
+	}
+	got, err := existingTrackIDs(context.Background(), c, "p")
+	if err != nil {
+		t.Fatalf("existingTrackIDs() error = %v", err)
+	}
+	want := map[spotify.ID]bool{"a": true, "b": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("existingTrackIDs() = %v, want %v", got, want)
+	}
+}
+
+// getTopTracks returns a nil page when Spotify sends none back.
+func TestFilterTracksNilPage(t *testing.T) {
+	got, excluded := filterTracks(nil, trackFilter{minPopularity: 50})
+	if got != nil || excluded != 0 {
+		t.Errorf("filterTracks(nil) = %v, %d, want nil, 0", got, excluded)
+	}
+}
+
+func TestPreferredPlaylist(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b spotify.SimplePlaylist
+		want spotify.ID
+	}{
+		{
+			name: "the user's own playlist",
+			a:    testPlaylist("theirs", "Favorite Short Term Tracks", "someone", 50),
+			b:    testPlaylist("mine", "Favorite Short Term Tracks", "me", 1),
+			want: "mine",
+		},
+		{
+			name: "more tracks",
+			a:    testPlaylist("s1", "Favorite Short Term Tracks", "me", 3),
+			b:    testPlaylist("s2", "Favorite Short Term Tracks", "me", 10),
+			want: "s2",
+		},
+		{
+			name: "lowest ID on a tie",
+			a:    testPlaylist("s2", "Favorite Short Term Tracks", "me", 3),
+			b:    testPlaylist("s1", "Favorite Short Term Tracks", "me", 3),
+			want: "s1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := preferredPlaylist("me", tt.a, tt.b).ID; got != tt.want {
+				t.Errorf("preferredPlaylist(a, b) = %v, want %v", got, tt.want)
+			}
+			if got := preferredPlaylist("me", tt.b, tt.a).ID; got != tt.want {
+				t.Errorf("preferredPlaylist(b, a) = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompleteAuthRejectsStaleState(t *testing.T) {
+	first, err := newState()
+	if err != nil {
+		t.Fatalf("newState() error = %v", err)
+	}
+	second, err := newState()
+	if err != nil {
+		t.Fatalf("newState() error = %v", err)
+	}
+	if first == second {
+		t.Fatalf("newState() returned %q twice", first)
+	}
+
+	// A callback from an earlier run's login page carries that run's state.
+	req := httptest.NewRequest(http.MethodGet, "/callback?code=abc&state="+first, nil)
+	if err := checkState(req, second); err == nil {
+		t.Errorf("checkState() = nil, want a state mismatch error")
+	}
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		// A login would be sent on ch, which nothing reads here, and block the handler.
+		completeAuth(second, "").ServeHTTP(rec, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("completeAuth() didn't return for a stale state")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("completeAuth() status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestCurrentUserWithoutID(t *testing.T) {
+	for _, id := range []string{"", "me"} {
+		calls := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"id": %q}`, id)
+		}))
+		defer srv.Close()
+		c := spotify.New(srv.Client(), spotify.WithBaseURL(srv.URL+"/"))
+
+		user, err := currentUser(context.Background(), c, backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 1))
+		if id == "" {
+			if err == nil {
+				t.Errorf("currentUser() = %+v, want an error for a user without an ID", user)
+			}
+			// A user without an ID is retried like a failed call.
+			if calls != 2 {
+				t.Errorf("currentUser() called /me %d times, want 2", calls)
+			}
+			continue
+		}
+		if err != nil || user.ID != id {
+			t.Errorf("currentUser() = %+v, %v, want user %v", user, err, id)
+		}
+	}
+}
+
+func TestRunTimeoutPausesAtPrompts(t *testing.T) {
+	var p pausableTimeout
+	ctx, cancel := p.start(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	resume := p.pause()
+	time.Sleep(100 * time.Millisecond)
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("ctx.Err() = %v while paused, want nil", err)
+	}
+	resume()
+	select {
+	case <-ctx.Done():
+		if cause := context.Cause(ctx); cause != context.DeadlineExceeded {
+			t.Errorf("context.Cause() = %v, want %v", cause, context.DeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout didn't resume after the prompt")
+	}
+}
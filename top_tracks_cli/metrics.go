@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// countingTransport counts every request sent to the Spotify API.
+type countingTransport struct {
+	base  http.RoundTripper
+	calls atomic.Int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls.Add(1)
+	return t.base.RoundTrip(req)
+}
+
+// apiCounter wraps the authenticated client's transport in completeAuth.
+var apiCounter = &countingTransport{}
+
+// phaseTimer accumulates how long each phase of a run took. Phases that run once per
+// playlist, concurrently, are summed, so they can add up to more than the wall time.
+type phaseTimer struct {
+	mu     sync.Mutex
+	order  []string
+	totals map[string]time.Duration
+}
+
+// phases is reported by --profile_phases.
+var phases = &phaseTimer{totals: make(map[string]time.Duration)}
+
+// since adds the time elapsed since start to phase name.
+func (t *phaseTimer) since(name string, start time.Time) {
+	d := time.Since(start)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.totals[name]; !ok {
+		t.order = append(t.order, name)
+	}
+	t.totals[name] += d
+}
+
+// reset forgets the recorded phases, for the next --watch run.
+func (t *phaseTimer) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.order = nil
+	t.totals = make(map[string]time.Duration)
+}
+
+// each calls f for every recorded phase in the order it was first seen.
+func (t *phaseTimer) each(f func(name string, d time.Duration)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, name := range t.order {
+		f(name, t.totals[name])
+	}
+}
+
+type runStats struct {
+	tracksAdded       int
+	duplicatesSkipped int
+	apiCalls          int64
+	rateLimited       int
+	longestRetryAfter time.Duration
+	duration          time.Duration
+	finished          time.Time
+	phases            *phaseTimer
+}
+
+// writeMetricsFile writes stats in the Prometheus textfile exposition format so that
+// node_exporter's textfile collector can scrape it. The file is written to a temporary
+// path and renamed into place so the collector never sees a partial file.
+func writeMetricsFile(path string, stats runStats) error {
+	var b strings.Builder
+	metric := func(name, help string, value interface{}) {
+		fmt.Fprintf(&b, "# HELP top_tracks_cli_%s %s\n", name, help)
+		fmt.Fprintf(&b, "# TYPE top_tracks_cli_%s gauge\n", name)
+		fmt.Fprintf(&b, "top_tracks_cli_%s %v\n", name, value)
+	}
+	metric("tracks_added", "Tracks added to playlists during the last run.", stats.tracksAdded)
+	metric("duplicates_skipped", "Tracks skipped as duplicates during the last run.", stats.duplicatesSkipped)
+	metric("api_calls", "Spotify API requests made during the last run.", stats.apiCalls)
+	metric("rate_limited", "Responses during the last run that were 429 Too Many Requests.", stats.rateLimited)
+	metric("longest_retry_after_seconds", "Longest Retry-After Spotify sent during the last run.", stats.longestRetryAfter.Seconds())
+	metric("run_duration_seconds", "Duration of the last run in seconds.", stats.duration.Seconds())
+	metric("last_run_timestamp", "Unix time the last run finished.", stats.finished.Unix())
+	if stats.phases != nil {
+		b.WriteString("# HELP top_tracks_cli_phase_duration_seconds Time spent in each phase of the last run.\n")
+		b.WriteString("# TYPE top_tracks_cli_phase_duration_seconds gauge\n")
+		stats.phases.each(func(name string, d time.Duration) {
+			fmt.Fprintf(&b, "top_tracks_cli_phase_duration_seconds{phase=%q} %v\n", name, d.Seconds())
+		})
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp(%v): %v", filepath.Dir(path), err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("WriteString(%v): %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
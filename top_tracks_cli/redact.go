@@ -0,0 +1,17 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// redact replaces s with a short stable hash when --redact is set, so output can be
+// shared without exposing user IDs, playlist IDs, or what someone listens to. The same
+// input always gives the same hash, so entries can still be told apart and matched up.
+func redact(s string) string {
+	if !*redactOutput || s == "" {
+		return s
+	}
+	sum := sha256.Sum256([]byte(s))
+	return "anon-" + hex.EncodeToString(sum[:])[:10]
+}
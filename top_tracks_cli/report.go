@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// playlistCounts are what a run did to one playlist.
+type playlistCounts struct {
+	Name string `json:"name"`
+	// Added are the tracks added by --fill, or that would be with --dry-run.
+	Added int `json:"added"`
+	// Skipped are the top tracks already on the playlist.
+	Skipped int `json:"skipped"`
+	// Filtered are the top tracks dropped by --exclude, --market, --min-energy, or
+	// --min-danceability.
+	Filtered int `json:"filtered"`
+	// Removed are the items removed by --purge_fav or --purge_dupes.
+	Removed int `json:"removed"`
+	// Tracks are the names of the tracks added with --append_new_only. Only the JSON
+	// summary has them.
+	Tracks []string `json:"tracks,omitempty"`
+	// Error is why filling or purging the playlist failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// runReport accumulates playlistCounts across a run. The fills run concurrently, so
+// it's safe for concurrent use.
+type runReport struct {
+	mu        sync.Mutex
+	playlists []*playlistCounts
+}
+
+// report is printed at the end of the playlist command.
+var report = &runReport{}
+
+// add applies f to the counts for the playlist called name.
+func (r *runReport) add(name string, f func(c *playlistCounts)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.playlists {
+		if c.Name == name {
+			f(c)
+			return
+		}
+	}
+	c := &playlistCounts{Name: name}
+	r.playlists = append(r.playlists, c)
+	f(c)
+}
+
+// reset forgets the counts recorded so far, for the next --watch run.
+func (r *runReport) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.playlists = nil
+}
+
+// fail records that filling or purging the playlist called name failed with err.
+func (r *runReport) fail(name string, err error) {
+	r.add(name, func(c *playlistCounts) { c.Error = strings.TrimSpace(err.Error()) })
+}
+
+// textOut is where the playlist command writes its human-readable lines: stdout, unless
+// --format json keeps stdout for the JSON summary, in which case they go to stderr.
+func textOut() io.Writer {
+	if *playlistFormat == "json" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// write prints the counts as a table, or as a JSON object when format is "json". It
+// prints nothing if nothing was recorded.
+func (r *runReport) write(w io.Writer, format string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.playlists) == 0 {
+		return nil
+	}
+	total := playlistCounts{Name: "total"}
+	rows := make([]playlistCounts, 0, len(r.playlists))
+	for _, c := range r.playlists {
+		rows = append(rows, *c)
+		total.Added += c.Added
+		total.Skipped += c.Skipped
+		total.Filtered += c.Filtered
+		total.Removed += c.Removed
+	}
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Playlists []playlistCounts `json:"playlists"`
+			Total     playlistCounts   `json:"total"`
+		}{rows, total})
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "playlist\tadded\tskipped\tfiltered\tremoved\t")
+	for _, c := range append(rows, total) {
+		fmt.Fprintf(tw, "%v\t%d\t%d\t%d\t%d\t\n", c.Name, c.Added, c.Skipped, c.Filtered, c.Removed)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// sampleTracks returns n tracks picked at random from page, kept in their original
+// order. The same seed always picks the same tracks from the same page. When the
+// filters left fewer than n tracks, all of them are kept, with a warning.
+func sampleTracks(page *spotify.FullTrackPage, name string, n int, seed int64) *spotify.FullTrackPage {
+	if page == nil || n <= 0 {
+		return page
+	}
+	if n >= len(page.Tracks) {
+		if n > len(page.Tracks) {
+			slog.Warn("--sample is more than the tracks available, using them all", "playlist", name, "sample", n, "tracks", len(page.Tracks))
+		}
+		return page
+	}
+	picked := rand.New(rand.NewSource(seed)).Perm(len(page.Tracks))[:n]
+	keep := make(map[int]bool, n)
+	for _, i := range picked {
+		keep[i] = true
+	}
+	sampled := *page
+	sampled.Tracks = nil
+	for i, t := range page.Tracks {
+		if keep[i] {
+			sampled.Tracks = append(sampled.Tracks, t)
+		}
+	}
+	return &sampled
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// runState is what the tool remembers between runs.
+type runState struct {
+	// Snapshots maps a playlist ID to its snapshot ID after the last fill.
+	Snapshots map[string]string `json:"snapshots"`
+	// Playlists maps a user ID, then an automatedSet's cacheKey, to the IDs of the
+	// set's playlists, in term order, so fills can skip listing every playlist.
+	Playlists map[string]map[string][]string `json:"playlists,omitempty"`
+}
+
+// statePath returns where runState is stored, in the --profile's config directory.
+func statePath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "state.json"), nil
+}
+
+// loadState reads the saved state. A missing file isn't an error and yields an empty state.
+func loadState() (*runState, error) {
+	st := &runState{Snapshots: make(map[string]string)}
+	path, err := statePath()
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(%v): %v", path, err)
+	}
+	if st.Snapshots == nil {
+		st.Snapshots = make(map[string]string)
+	}
+	return st, nil
+}
+
+// saveState writes st, creating the config directory if needed.
+func saveState(st *runState) error {
+	path, err := statePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// runTimeout is --timeout for the current run. confirm and choose pause it while they
+// wait for an answer, so a slow reply at a prompt doesn't use up the time meant for the
+// Spotify calls.
+var runTimeout pausableTimeout
+
+type pausableTimeout struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	left    time.Duration
+	started time.Time
+}
+
+// start returns a copy of ctx that is cancelled, with context.DeadlineExceeded as its
+// cause, once d has passed outside of pauses. pause applies to the timeout started last.
+func (p *pausableTimeout) start(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := time.AfterFunc(d, func() { cancel(context.DeadlineExceeded) })
+	p.timer, p.left, p.started = t, d, time.Now()
+	return ctx, func() {
+		p.mu.Lock()
+		t.Stop()
+		if p.timer == t {
+			p.timer = nil
+		}
+		p.mu.Unlock()
+		cancel(context.Canceled)
+	}
+}
+
+// pause stops the clock until the returned func is called. It does nothing when no
+// timeout is running or it has already passed.
+func (p *pausableTimeout) pause() (resume func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := p.timer
+	if t == nil || !t.Stop() {
+		return func() {}
+	}
+	p.left -= time.Since(p.started)
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		// The run may have ended while the prompt was open.
+		if p.timer != t {
+			return
+		}
+		p.started = time.Now()
+		t.Reset(p.left)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+	spotifyauth "github.com/zmb3/spotify/v2/auth"
+	"golang.org/x/oauth2"
+)
+
+// loadToken reads an OAuth token saved as JSON.
+func loadToken(path string) (*oauth2.Token, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tok oauth2.Token
+	if err := json.Unmarshal(b, &tok); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(%v): %v", path, err)
+	}
+	if tok.AccessToken == "" && tok.RefreshToken == "" {
+		return nil, fmt.Errorf("%v doesn't contain an access or refresh token", path)
+	}
+	return &tok, nil
+}
+
+// configDir returns the directory holding the cached token and run state of the
+// --profile in use, so each account's files are kept apart.
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "top_tracks_cli", *profile), nil
+}
+
+// checkProfile returns an error if name can't be used as a directory name by configDir.
+func checkProfile(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("--profile %q must be a plain name, e.g. work", name)
+	}
+	return nil
+}
+
+// migrateConfigDir moves the token and state files written before --profile existed
+// into the default profile's directory, unless it already has its own.
+func migrateConfigDir() error {
+	if *profile != defaultProfile {
+		return nil
+	}
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return err
+	}
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"token.json", "state.json"} {
+		old, path := filepath.Join(base, "top_tracks_cli", name), filepath.Join(dir, name)
+		if _, err := os.Stat(old); err != nil {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(old, path); err != nil {
+			return err
+		}
+		slog.Debug("moved file into the default profile", "from", old, "to", path)
+	}
+	return nil
+}
+
+// tokenCachePath returns where the login token is cached between runs.
+func tokenCachePath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "token.json"), nil
+}
+
+// saveToken writes tok as JSON, readable only by the user.
+func saveToken(path string, tok *oauth2.Token) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+// newAPIClient returns a Spotify client using tok, with the tool's transports. Expired
+// access tokens are refreshed by the client as needed.
+func newAPIClient(tok *oauth2.Token) *spotify.Client {
+	httpClient := auth.Client(withHTTPTimeout(context.Background()), tok)
+	httpClient.Timeout = *httpTimeout
+	pacer.base = &userAgentTransport{base: httpClient.Transport, userAgent: *userAgent}
+	apiCounter.base = pacer
+	httpClient.Transport = apiCounter
+	return spotify.New(httpClient)
+}
+
+// cachedClient returns a client for the token cached by an earlier login, refreshing
+// and re-saving it if it has expired.
+func cachedClient(ctx context.Context) (*spotify.Client, error) {
+	path, err := tokenCachePath()
+	if err != nil {
+		return nil, err
+	}
+	tok, err := loadToken(path)
+	if err != nil {
+		return nil, err
+	}
+	if !tok.Valid() {
+		tok, err = auth.RefreshToken(withHTTPTimeout(ctx), tok)
+		if err != nil {
+			return nil, fmt.Errorf("RefreshToken(): %v", err)
+		}
+		if err := saveToken(path, tok); err != nil {
+			return nil, fmt.Errorf("saveToken(%v): %v", path, err)
+		}
+	}
+	return newAPIClient(tok), nil
+}
+
+// scopeProbes are cheap calls that each need one of the scopes the tool relies on.
+var scopeProbes = []struct {
+	scope string
+	probe func(ctx context.Context, c *spotify.Client) error
+}{
+	{spotifyauth.ScopeUserTopRead, func(ctx context.Context, c *spotify.Client) error {
+		_, err := c.CurrentUsersTopTracks(ctx, spotify.Limit(1))
+		return err
+	}},
+	{spotifyauth.ScopePlaylistReadPrivate, func(ctx context.Context, c *spotify.Client) error {
+		_, err := c.CurrentUsersPlaylists(ctx, spotify.Limit(1))
+		return err
+	}},
+}
+
+// checkToken verifies the token at path without opening a browser: it refreshes the
+// token if it has expired, confirms it works with a CurrentUser call, and probes the
+// scopes the tool needs. An error is returned if any check fails.
+func checkToken(ctx context.Context, path string) error {
+	ctx = withHTTPTimeout(ctx)
+	tok, err := loadToken(path)
+	if err != nil {
+		return fmt.Errorf("loadToken(%v): %v", path, err)
+	}
+	if !tok.Valid() {
+		fmt.Println("Token has expired, refreshing")
+		tok, err = auth.RefreshToken(ctx, tok)
+		if err != nil {
+			return fmt.Errorf("RefreshToken(): %v", err)
+		}
+	}
+	httpClient := auth.Client(ctx, tok)
+	httpClient.Timeout = *httpTimeout
+	httpClient.Transport = &userAgentTransport{base: httpClient.Transport, userAgent: *userAgent}
+	client := spotify.New(httpClient)
+
+	user, err := client.CurrentUser(ctx)
+	if err != nil {
+		return fmt.Errorf("CurrentUser(): %v", err)
+	}
+	fmt.Printf("Token is valid for user %v, expires %v\n", redact(user.ID), tok.Expiry.Local().Format("2006-01-02 15:04:05"))
+
+	if missing := probeScopes(ctx, client); len(missing) > 0 {
+		return fmt.Errorf("token is missing %d required scopes: %v", len(missing), missing)
+	}
+	return nil
+}
+
+// probeScopes runs scopeProbes, printing each result, and returns the scopes that failed.
+func probeScopes(ctx context.Context, c *spotify.Client) []string {
+	var missing []string
+	for _, p := range scopeProbes {
+		if err := p.probe(ctx, c); err != nil {
+			fmt.Printf("scope %v: failed (%v)\n", p.scope, err)
+			missing = append(missing, p.scope)
+			continue
+		}
+		fmt.Printf("scope %v: ok\n", p.scope)
+	}
+	return missing
+}
+
+// tokenScopes prints the scopes granted to the token at path and returns an error if
+// any of requiredScopes is missing. Saved tokens don't record their scopes, but Spotify
+// lists them when a token is refreshed, so the token is always refreshed. If the token
+// can't be refreshed, the scopes are probed with API calls instead.
+func tokenScopes(ctx context.Context, path string) error {
+	ctx = withHTTPTimeout(ctx)
+	tok, err := loadToken(path)
+	if err != nil {
+		return fmt.Errorf("loadToken(%v): %v", path, err)
+	}
+	if tok.RefreshToken != "" {
+		// An unexpired token isn't refreshed by the oauth2 package, so force it.
+		tok.Expiry = time.Now().Add(-time.Minute)
+		refreshed, err := auth.RefreshToken(ctx, tok)
+		if err != nil {
+			return fmt.Errorf("RefreshToken(): %v", err)
+		}
+		if scope, ok := refreshed.Extra("scope").(string); ok {
+			granted := make(map[string]bool)
+			for _, s := range strings.Fields(scope) {
+				granted[s] = true
+				fmt.Printf("granted: %v\n", s)
+			}
+			var missing []string
+			for _, s := range requiredScopes {
+				if !granted[s] {
+					missing = append(missing, s)
+				}
+			}
+			if len(missing) > 0 {
+				return fmt.Errorf("token lacks %d scopes this version needs, log in again to grant them: %v", len(missing), missing)
+			}
+			fmt.Println("Token has every scope this version needs")
+			return nil
+		}
+		tok = refreshed
+	}
+
+	fmt.Println("Spotify didn't report the token's scopes, probing them instead")
+	httpClient := auth.Client(ctx, tok)
+	httpClient.Timeout = *httpTimeout
+	httpClient.Transport = &userAgentTransport{base: httpClient.Transport, userAgent: *userAgent}
+	if missing := probeScopes(ctx, spotify.New(httpClient)); len(missing) > 0 {
+		return fmt.Errorf("token is missing %d required scopes: %v", len(missing), missing)
+	}
+	return nil
+}
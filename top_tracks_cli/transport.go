@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// version is the tool version reported in the User-Agent. Release builds can set it
+// with -ldflags "-X main.version=...".
+var version = "dev"
+
+// userAgentTransport sets the User-Agent header on every request.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the caller's request.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(req)
+}
+
+// pacingTransport holds back every request after Spotify answers one with 429 Too Many
+// Requests, until the Retry-After it sent has passed. The concurrent fills share one
+// client, so a limit hit by one of them pauses the others instead of letting them run
+// into it too.
+type pacingTransport struct {
+	base http.RoundTripper
+
+	mu           sync.Mutex
+	notBefore    time.Time
+	limited      int
+	longestRetry time.Duration
+}
+
+// pacer wraps the authenticated client's transport, below apiCounter.
+var pacer = &pacingTransport{}
+
+// wait returns how long requests are being held back for a Retry-After, if at all.
+func (t *pacingTransport) wait() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Until(t.notBefore)
+}
+
+// limits returns how many responses were 429s and the longest Retry-After among them.
+func (t *pacingTransport) limits() (int, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limited, t.longestRetry
+}
+
+// resetLimits forgets the 429s counted so far, for the next --watch run. Requests are
+// still held back for a Retry-After that hasn't passed.
+func (t *pacingTransport) resetLimits() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limited, t.longestRetry = 0, 0
+}
+
+func (t *pacingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if wait := t.wait(); wait > 0 {
+		slog.Debug("waiting out Spotify's Retry-After", "url", req.URL.Path, "wait", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	d, ok := retryAfter(resp.Header.Get("Retry-After"))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limited++
+	if ok {
+		if d > t.longestRetry {
+			t.longestRetry = d
+		}
+		if until := time.Now().Add(d); until.After(t.notBefore) {
+			t.notBefore = until
+		}
+	}
+	return resp, nil
+}
+
+// jitterRetryAfter returns a random duration between wait and twice wait. The
+// concurrent fills all see the same Retry-After, and without it they'd retry together
+// the moment it passes and be rate limited again. The exponential backoff's own jitter
+// doesn't apply, as the Retry-After replaces its interval.
+func jitterRetryAfter(wait time.Duration) time.Duration {
+	return wait + time.Duration(rand.Int63n(int64(wait)+1))
+}
+
+// retryAfter parses a Retry-After header, given either in seconds or as an HTTP date.
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// withHTTPTimeout returns ctx carrying an HTTP client with the --http_timeout timeout,
+// which the oauth2 package uses for token exchanges and refreshes.
+func withHTTPTimeout(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Timeout: *httpTimeout})
+}